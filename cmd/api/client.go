@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"go.opencensus.io/plugin/ochttp"
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescedCalls makes identical concurrent outbound calls (by method and url) share a single call,
+// so a burst of requests doesn't stampede the upstream
+var coalescedCalls singleflight.Group
+
+// defaultTransport is the transport used by DefaultHTTPClient to make the actual connections
+var defaultTransport = &http.Transport{
+	// Egress through a proxy is configured with the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env variables
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout: 10 * time.Second,
+	}).DialContext,
+
+	MaxIdleConns:        200,
+	MaxIdleConnsPerHost: 100,
+}
+
+// outboundWorkers bounds the number of concurrent outgoing requests of DefaultHTTPClient
+var outboundWorkers = newWorkerPool(defaultTransport, 100, time.Second)
+
+// tracingTransport adds the trace context to the outgoing requests of DefaultHTTPClient, in the configured format
+var tracingTransport = &ochttp.Transport{
+	Base:        outboundWorkers,
+	Propagation: &propagation.HTTPFormat{},
+}
+
+// DefaultHTTPClient is a client to be used for each outgoing HTTP request.
+// It adds trace propagation and timeout settings.
+var DefaultHTTPClient = &http.Client{
+	Transport: tracingTransport,
+	Timeout:   0,
+}
+
+// healthCheckHTTPClient is the client for the dependency checks of the readiness endpoint. It bypasses the worker pool
+// (and tracing) of DefaultHTTPClient, so a burst of outbound calls can't make the readiness check fail.
+var healthCheckHTTPClient = &http.Client{
+	Transport: defaultTransport,
+}
+
+const deadlineHeader = "X-Request-Deadline-Ms"
+
+// statusClientClosedRequest is the (non-standard, nginx) status code for requests which were cancelled by the client
+const statusClientClosedRequest = 499
+
+var (
+	deadlineHeaderBuffer          = 50 * time.Millisecond
+	maxResponseBytes        int64 = 10 << 20
+	circuitBreakerThreshold       = 5
+	circuitBreakerCooldown        = 30 * time.Second
+	circuitBreakers               = make(map[string]*circuitBreaker)
+	circuitBreakersMutex    sync.Mutex
+	circuitBreakersMaxHosts = 1000
+	allowDebug              = false
+	debugMaxBodyBytes       = 64 << 10
+	debugRedactedHeaders    = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	retryAfterMaxRetries    = 1
+	retryAfterMaxWait       = 5 * time.Second
+	forwardedHeadersMaxSize = 64 << 10
+)
+
+// parseRetryAfter returns the time to wait given in a Retry-After header, either in seconds or as HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// retryAfterWait returns how long to wait before retrying the request of the response, if the upstream asked for
+// a retry with a 429 or 503 and a Retry-After header. The wait is capped at maxWait.
+func retryAfterWait(resp *http.Response, maxWait time.Duration) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return 0, false
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait, true
+}
+
+// errOutboundQueueTimeout is returned for outgoing requests which didn't get a worker of the pool in time
+var errOutboundQueueTimeout = errors.New("outbound_queue_full: no worker became available for the outbound call in time")
+
+// workerPool is a http.RoundTripper which dispatches the requests to the base transport with a bounded number of
+// workers, each request holding a worker until its response body is closed. Requests wait in the queue for a free
+// worker for at most queueTimeout, after which they fail with errOutboundQueueTimeout.
+// A pool without workers doesn't bound the requests.
+type workerPool struct {
+	base         http.RoundTripper
+	workers      chan struct{}
+	queueTimeout time.Duration
+}
+
+// newWorkerPool returns a pool with the given number of workers (0 for no limit) dispatching to base
+func newWorkerPool(base http.RoundTripper, size int, queueTimeout time.Duration) *workerPool {
+	p := &workerPool{base: base, queueTimeout: queueTimeout}
+	p.resize(size)
+	return p
+}
+
+// resize sets the number of workers of the pool, which must only be done before any request is made
+func (p *workerPool) resize(size int) {
+	p.workers = nil
+	if size > 0 {
+		p.workers = make(chan struct{}, size)
+	}
+}
+
+// size returns the number of workers of the pool, 0 if it doesn't bound the requests
+func (p *workerPool) size() int {
+	return cap(p.workers)
+}
+
+// RoundTrip waits for a free worker and performs the request with it
+func (p *workerPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p.workers == nil {
+		return p.base.RoundTrip(req)
+	}
+	// A free worker is taken right away, only otherwise the request waits in the queue. Waiting straight away
+	// could reject the request with a short queue timeout, as select picks any of the ready cases.
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		timer := time.NewTimer(p.queueTimeout)
+		select {
+		case p.workers <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			return nil, errOutboundQueueTimeout
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	release := func() { <-p.workers }
+	resp, err := p.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody is a response body which releases the worker of its request once closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// circuitBreaker keeps track of consecutive failures for calls to a single host.
+// It opens after a number of consecutive failures, rejecting calls until a cool-down has elapsed,
+// after which calls are let through again (half-open) until one succeeds and closes it, or one fails and re-opens it.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	lastUsed  time.Time
+}
+
+// getCircuitBreaker returns the circuit breaker of the given host, creating it if it doesn't exist yet.
+// The number of hosts which are kept track of is capped at circuitBreakersMaxHosts, see evictCircuitBreakersLocked.
+func getCircuitBreaker(host string) *circuitBreaker {
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+
+	cb, ok := circuitBreakers[host]
+	if !ok {
+		if len(circuitBreakers) >= circuitBreakersMaxHosts {
+			evictCircuitBreakersLocked()
+		}
+		cb = &circuitBreaker{threshold: circuitBreakerThreshold, cooldown: circuitBreakerCooldown}
+		circuitBreakers[host] = cb
+	}
+	cb.mutex.Lock()
+	cb.lastUsed = time.Now()
+	cb.mutex.Unlock()
+	return cb
+}
+
+// evictCircuitBreakersLocked makes room for a new circuit breaker. Breakers without failures are dropped, as they are
+// the same as new ones. If all of them have failures, the least recently used one is dropped.
+// The circuitBreakersMutex must be held.
+func evictCircuitBreakersLocked() {
+	var oldestHost string
+	var oldest time.Time
+	for host, cb := range circuitBreakers {
+		cb.mutex.Lock()
+		failures, lastUsed := cb.failures, cb.lastUsed
+		cb.mutex.Unlock()
+		if failures == 0 {
+			delete(circuitBreakers, host)
+		} else if oldestHost == "" || lastUsed.Before(oldest) {
+			oldestHost, oldest = host, lastUsed
+		}
+	}
+	if len(circuitBreakers) >= circuitBreakersMaxHosts {
+		delete(circuitBreakers, oldestHost)
+	}
+}
+
+// stateLocked returns the state of the breaker: "closed", "open" or "half-open". The mutex must be held.
+func (cb *circuitBreaker) stateLocked() string {
+	if cb.threshold <= 0 || cb.failures < cb.threshold {
+		return "closed"
+	}
+	if time.Since(cb.openedAt) < cb.cooldown {
+		return "open"
+	}
+	return "half-open"
+}
+
+// allow returns whether a call may be made
+func (cb *circuitBreaker) allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.stateLocked() != "open"
+}
+
+// record registers the outcome of a call
+func (cb *circuitBreaker) record(success bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if success {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.threshold > 0 && cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+	}
+}
+
+// info returns the state of the breaker, to be included in responses
+func (cb *circuitBreaker) info() map[string]interface{} {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return map[string]interface{}{
+		"state":               cb.stateLocked(),
+		"consecutiveFailures": cb.failures,
+	}
+}
+
+// isUpstreamFailure returns whether a call counts as failed for the circuit breaker
+func isUpstreamFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// readLimited reads at most limit bytes from the reader, returning whether there was more data which was not read
+func readLimited(r io.Reader, limit int64) ([]byte, bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return body, false, err
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], true, nil
+	}
+	return body, false, nil
+}
+
+// decodeContentEncoding decompresses a gzip or deflate encoded response body, reading at most limit bytes of the
+// decompressed body, and returns whether there was more. Bodies which the transport already decompressed (because
+// it asked for gzip itself), or without a known encoding, are returned as is.
+func decodeContentEncoding(resp *http.Response, body []byte, limit int64) ([]byte, bool, error) {
+	if resp.Uncompressed {
+		return body, false, nil
+	}
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, false, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		// Deflate should be zlib wrapped, but some servers send the raw deflate stream
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			reader = zlibReader
+		}
+	default:
+		return body, false, nil
+	}
+	decoded, truncated, err := readLimited(reader, limit)
+	if err != nil {
+		return body, false, fmt.Errorf("invalid %v body: %v", resp.Header.Get("Content-Encoding"), err)
+	}
+	return decoded, truncated, nil
+}
+
+// drainAndClose reads (a bounded amount of) the remainder of a response body before closing it,
+// so the underlying connection can be reused by the transport.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
+
+// setDeadlineHeader passes the time remaining until the deadline of the context (minus a small buffer
+// to account for the network) to the upstream in a header, so it can bail early if the deadline is about to expire.
+// The header is not set when the context has no deadline.
+func setDeadlineHeader(ctx context.Context, req *http.Request) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline) - deadlineHeaderBuffer
+	if remaining < 0 {
+		remaining = 0
+	}
+	req.Header.Set(deadlineHeader, strconv.FormatInt(remaining.Nanoseconds()/int64(time.Millisecond), 10))
+}
+
+// redactHeaders returns a copy of the headers in which the values of the headers configured as sensitive are masked
+func redactHeaders(headers http.Header) http.Header {
+	redacted := make(http.Header, len(headers))
+	for name, values := range headers {
+		redacted[name] = values
+		for _, sensitive := range debugRedactedHeaders {
+			if strings.EqualFold(name, strings.TrimSpace(sensitive)) {
+				redacted[name] = []string{"***"}
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// truncateDebugBody returns the body as a string, cut off at debugMaxBodyBytes
+func truncateDebugBody(body []byte) (string, bool) {
+	if len(body) > debugMaxBodyBytes {
+		return string(body[:debugMaxBodyBytes]), true
+	}
+	return string(body), false
+}
+
+// getDebugRequestInfo returns the details of an outgoing request, with the sensitive headers redacted
+func getDebugRequestInfo(req *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"method":  req.Method,
+		"url":     req.URL.String(),
+		"headers": redactHeaders(req.Header),
+	}
+}
+
+// getDebugResponseInfo returns the details of a response to an outgoing request, with the sensitive headers redacted
+// and the body bounded in size
+func getDebugResponseInfo(resp *http.Response, body []byte) map[string]interface{} {
+	bodyString, truncated := truncateDebugBody(body)
+	return map[string]interface{}{
+		"statusCode":    resp.StatusCode,
+		"protocol":      resp.Proto,
+		"headers":       redactHeaders(resp.Header),
+		"body":          bodyString,
+		"bodyTruncated": truncated,
+	}
+}
+
+// hopByHopHeaders are the headers which only apply to a single connection (RFC 7230, section 6.1),
+// so they must not be forwarded by proxies
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade",
+}
+
+// sanitizeForwardedHeaders returns the headers of an upstream response which can be forwarded to the client:
+// without the hop-by-hop headers (including the ones listed in the Connection header), without duplicate values,
+// and limited to maxSize bytes in total. Headers beyond the limit are dropped, in order of their names.
+func sanitizeForwardedHeaders(headers http.Header, maxSize int) http.Header {
+	removed := make(map[string]bool)
+	for _, name := range hopByHopHeaders {
+		removed[name] = true
+	}
+	for _, value := range headers["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				removed[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sanitized := make(http.Header, len(headers))
+	size := 0
+	for _, name := range names {
+		if removed[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, value := range headers[name] {
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			// The size of the header line "Name: value\r\n"
+			if size += len(name) + len(value) + 4; size > maxSize {
+				return sanitized
+			}
+			sanitized.Add(name, value)
+		}
+	}
+	return sanitized
+}
+
+// outboundTLSConfig returns the TLS config of defaultTransport, creating it if it isn't set yet
+func outboundTLSConfig() *tls.Config {
+	if defaultTransport.TLSClientConfig == nil {
+		defaultTransport.TLSClientConfig = &tls.Config{}
+	}
+	return defaultTransport.TLSClientConfig
+}
+
+// configureOutboundTLS loads a client certificate and key (for mutual TLS) and/or a bundle of CA certificates
+// to verify servers with into the TLS config of the transport for outgoing requests. Empty file names are skipped,
+// leaving the transport's defaults untouched.
+func configureOutboundTLS(certFile string, keyFile string, caBundleFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("both a client certificate and key must be given")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("could not load client certificate: %v", err)
+		}
+		outboundTLSConfig().Certificates = []tls.Certificate{cert}
+	}
+	if caBundleFile != "" {
+		caBundle, err := ioutil.ReadFile(caBundleFile)
+		if err != nil {
+			return fmt.Errorf("could not read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return fmt.Errorf("no certificates found in CA bundle %v", caBundleFile)
+		}
+		outboundTLSConfig().RootCAs = pool
+	}
+	return nil
+}
+
+// proxyEnvironment returns the proxy env variables (in upper or lower case) used for the outbound calls, for logging.
+// Passwords in the proxy urls are left out.
+func proxyEnvironment() map[string]string {
+	settings := make(map[string]string)
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		value := os.Getenv(name)
+		if value == "" {
+			value = os.Getenv(strings.ToLower(name))
+		}
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			u.User = url.User(u.User.Username())
+			value = u.String()
+		}
+		settings[name] = value
+	}
+	return settings
+}
+
+// validateOutboundURL checks that a url to call is an absolute http(s) url, to avoid calls to e.g. local files
+func validateOutboundURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %v", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %q: scheme must be http or https", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q: missing host", rawURL)
+	}
+	return u, nil
+}
@@ -2,43 +2,151 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
-	"go.opencensus.io/plugin/ochttp"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap/zapcore"
 )
 
-var podLabels map[string]string
-var environmentVariables map[string]string
+var (
+	processStartTime = time.Now()
 
-// DefaultHTTPClient is a client to be used for each outgoing HTTP request.
-// It adds trace propagation and timeout settings.
-var DefaultHTTPClient = &http.Client{
-	Transport: &ochttp.Transport{
-		Base: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).DialContext,
+	// podLabels caches the labels after they were read successfully. After a failed read, the result with the error
+	// is kept in podLabelsFailure for labelsRetryInterval, so the file isn't read on every request.
+	podLabels             map[string]string
+	podLabelsFailure      map[string]string
+	podLabelsFailedAt     time.Time
+	podLabelsMutex        sync.Mutex
+	podLabelsFile         = "/etc/podinfo/labels"
+	labelsRetryInterval   = 5 * time.Second
+	labelsFormat          = "auto"
+	environmentVariables  map[string]string
+	environmentMutex      sync.Mutex
+	wsMaxMessageBytes     int64 = 64 << 10
+	wsReadTimeout               = 60 * time.Second
+	wsWriteTimeout              = 10 * time.Second
+	wsShutdownGracePeriod       = 5 * time.Second
+	maxDelay                    = 30 * time.Second
+	maxBytes              int64 = 100 << 20
+	rawMaxBodyBytes       int64 = 64 << 10
+	requestSpecMaxBytes   int64 = 1 << 20
+	dnsLookupTimeout            = 2 * time.Second
+	formMaxBytes          int64 = 64 << 10
+)
 
-			MaxIdleConns:        200,
-			MaxIdleConnsPerHost: 100,
-		},
-		Propagation: &propagation.HTTPFormat{},
-	},
-	Timeout: 0,
+/************************** Liveness server **************************/
+
+// healthService contains the handlers to handle health and readiness checks
+type healthService struct {
+	dependencies []dependency
+	// writePath is a directory which must be writable for the server to be ready, not checked when empty
+	writePath string
 }
 
-/************************** Liveness server **************************/
+// shuttingDown is set to 1 once the server starts shutting down, which makes the readiness check fail
+var shuttingDown int32
+
+// setShuttingDown makes the readiness check fail, so no new traffic is sent to the server
+func setShuttingDown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
 
-// healthService contains only a handler to handle health checks
-type healthService struct{}
+// dependency is an upstream service which is checked by the readiness check
+type dependency struct {
+	name           string
+	url            string
+	expectedStatus int
+	timeout        time.Duration
+	optional       bool
+}
+
+// parseDependencies parses a comma-separated list of dependencies of the form
+// "name=url[;status=<code>][;timeout=<duration>][;optional]", e.g.
+// "db=http://db:8080/health,cache=http://cache/healthz;status=204;optional".
+func parseDependencies(spec string, defaultTimeout time.Duration) ([]dependency, error) {
+	dependencies := []dependency{}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ";")
+		pair := strings.SplitN(parts[0], "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid dependency %q, expected name=url", entry)
+		}
+		dep := dependency{name: pair[0], url: pair[1], expectedStatus: http.StatusOK, timeout: defaultTimeout}
+		for _, option := range parts[1:] {
+			var err error
+			switch {
+			case option == "optional":
+				dep.optional = true
+			case strings.HasPrefix(option, "status="):
+				dep.expectedStatus, err = strconv.Atoi(strings.TrimPrefix(option, "status="))
+			case strings.HasPrefix(option, "timeout="):
+				dep.timeout, err = time.ParseDuration(strings.TrimPrefix(option, "timeout="))
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid option %q for dependency %v: %v", option, dep.name, err)
+			}
+		}
+		dependencies = append(dependencies, dep)
+	}
+	return dependencies, nil
+}
+
+// check calls the dependency and returns its state: whether it is ok, the latency of the call and the error if it is not ok
+func (d dependency) check(ctx context.Context) map[string]interface{} {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	start := time.Now()
+	result := map[string]interface{}{"ok": false, "optional": d.optional}
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = healthCheckHTTPClient.Do(req.WithContext(ctx))
+		if err == nil {
+			drainAndClose(resp.Body)
+			if resp.StatusCode != d.expectedStatus {
+				err = fmt.Errorf("unexpected status %v, expected %v", resp.StatusCode, d.expectedStatus)
+			}
+		}
+	}
+	result["latency_ms"] = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		result["error"] = err.Error()
+	} else {
+		result["ok"] = true
+	}
+	return result
+}
 
 func (h *healthService) healthCheck() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -46,8 +154,169 @@ func (h *healthService) healthCheck() http.HandlerFunc {
 	}
 }
 
+// checkWritable checks that a file can be created in and removed from the directory,
+// to catch e.g. a read-only filesystem
+func checkWritable(dir string) map[string]interface{} {
+	start := time.Now()
+	result := map[string]interface{}{"ok": false, "path": dir}
+	file, err := ioutil.TempFile(dir, ".readiness-")
+	if err == nil {
+		_, err = file.Write([]byte("ok"))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if removeErr := os.Remove(file.Name()); err == nil {
+			err = removeErr
+		}
+	}
+	result["latency_ms"] = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		result["error"] = err.Error()
+	} else {
+		result["ok"] = true
+	}
+	return result
+}
+
+// readinessCheck checks all dependencies concurrently, and returns a json with the state of each of them.
+// It responds with a 503 if any of the non-optional dependencies is not ok, if the HEALTH_WRITE_PATH isn't writable,
+// during the warmup period after startup (so the pod only receives traffic once its connection pools and caches had
+// time to warm up), or if the server is shutting down.
+func (h *healthService) readinessCheck() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			writeJSON(w, r, http.StatusServiceUnavailable, map[string]interface{}{"ready": false, "shuttingDown": true})
+			return
+		}
+		if remaining := warmupDuration - time.Since(processStartTime); remaining > 0 {
+			writeJSON(w, r, http.StatusServiceUnavailable, map[string]interface{}{"ready": false, "warmingUp": true, "warmupRemaining": remaining.Round(time.Millisecond).String()})
+			return
+		}
+
+		results := make([]map[string]interface{}, len(h.dependencies))
+		var wg sync.WaitGroup
+		for i, dep := range h.dependencies {
+			wg.Add(1)
+			go func(i int, dep dependency) {
+				defer wg.Done()
+				results[i] = dep.check(r.Context())
+			}(i, dep)
+		}
+		wg.Wait()
+
+		ready := true
+		dependencies := make(map[string]interface{})
+		for i, dep := range h.dependencies {
+			dependencies[dep.name] = results[i]
+			if results[i]["ok"] != true && !dep.optional {
+				ready = false
+			}
+		}
+
+		response := map[string]interface{}{"dependencies": dependencies}
+		if h.writePath != "" {
+			writable := checkWritable(h.writePath)
+			response["checks"] = map[string]interface{}{"diskWritable": writable}
+			if writable["ok"] != true {
+				ready = false
+			}
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		response["ready"] = ready
+		writeJSON(w, r, status, response)
+	}
+}
+
 /************************** Main server **************************/
 
+// setJSONError adds the fields shared by all error responses to the given map: an "error" message and a "status" code.
+func setJSONError(m map[string]interface{}, status int, msg string) map[string]interface{} {
+	m["error"] = msg
+	m["status"] = status
+	return m
+}
+
+// writeJSON writes a json response with the given status code. The json is compact, unless the request has
+// the "pretty" param set (e.g. "?pretty=1"), in which case it's indented to be readable in a browser.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	if pretty := r.URL.Query().Get("pretty"); pretty == "1" || pretty == "true" {
+		encoder.SetIndent("", "  ")
+	}
+	encoder.Encode(v)
+}
+
+// accepts returns whether the Accept header allows a response of one of the media types (e.g. "application/json").
+// An empty header accepts everything, ranges (e.g. "application/*") are supported and types with q=0 are refused.
+func accepts(accept string, mediaTypes []string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		acceptedType := strings.ToLower(strings.TrimSpace(params[0]))
+		refused := false
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if value, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && value == 0 {
+					refused = true
+				}
+			}
+		}
+		if refused {
+			continue
+		}
+		for _, mediaType := range mediaTypes {
+			if acceptedType == "*/*" || acceptedType == mediaType ||
+				(strings.HasSuffix(acceptedType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(acceptedType, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negotiate checks with STRICT_NEGOTIATION whether the request accepts one of the media types the handler can produce.
+// If not, it writes a 406 listing them and returns false. Without strict negotiation, the response is always
+// produced (e.g. json for clients which only accept html).
+func negotiate(w http.ResponseWriter, r *http.Request, mediaTypes ...string) bool {
+	if !strictNegotiation || accepts(r.Header.Get("Accept"), mediaTypes) {
+		return true
+	}
+	response := setJSONError(make(map[string]interface{}), http.StatusNotAcceptable, fmt.Sprintf("ERROR: None of the accepted types %q can be produced", r.Header.Get("Accept")))
+	response["producible"] = mediaTypes
+	writeJSON(w, r, http.StatusNotAcceptable, response)
+	return false
+}
+
+// writeJSONError writes an error response with the given status code, shaped as {"error": "...", "status": <code>}
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(setJSONError(make(map[string]interface{}), status, msg))
+}
+
+// notFoundHandler writes a json error for requests which don't match any route
+func notFoundHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("ERROR: Not found: no route for path %v", r.URL.Path))
+	}
+}
+
+// methodNotAllowedHandler writes a json error for requests which match the path of a route, but not its methods
+func methodNotAllowedHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("ERROR: Method %v not allowed for path %v", r.Method, r.URL.Path))
+	}
+}
+
 // service contains the handlers of the server
 type service struct {
 	name string
@@ -61,38 +330,142 @@ func newService(name string) *service {
 
 // getServiceLabels returns the set of labels being applied to the service,
 // reading them from a file, which in k8s's case if mounted as a volume via the downwards API.
+// Successful reads are cached, failed ones are retried once labelsRetryInterval has passed.
 func getServiceLabels() map[string]string {
-	if podLabels == nil {
-		podLabels = make(map[string]string)
+	podLabelsMutex.Lock()
+	defer podLabelsMutex.Unlock()
 
-		filename := "/etc/podinfo/labels"
-		if IsDevelopment() {
-			filename = "/tmp/podinfo/labels"
-		}
+	if podLabels != nil {
+		return podLabels
+	}
+	if podLabelsFailure != nil && time.Since(podLabelsFailedAt) < labelsRetryInterval {
+		return podLabelsFailure
+	}
 
-		file, err := os.Open(filename)
-		if err != nil {
-			podLabels["error"] = fmt.Sprintf("ERROR: Error opening file %++v: %++v", filename, err)
-			return podLabels
+	filename := podLabelsFile
+	if IsDevelopment() {
+		filename = "/tmp/podinfo/labels"
+	}
+
+	labels, err := readServiceLabels(filename)
+	if err != nil {
+		labels["error"] = err.Error()
+		podLabelsFailure, podLabelsFailedAt = labels, time.Now()
+		return podLabelsFailure
+	}
+	podLabels, podLabelsFailure = labels, nil
+	return podLabels
+}
+
+// readServiceLabels reads the labels from a file, in the format given by labelsFormat: "keyvalue", "json" or "auto"
+// to detect it from the contents. On error, the labels read so far are returned along with the error.
+// A missing file (e.g. when not running on k8s) is not an error, but means there are no labels.
+func readServiceLabels(filename string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	data, err := ioutil.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return labels, nil
+	}
+	if err != nil {
+		return labels, fmt.Errorf("ERROR: Error reading file %++v: %++v", filename, err)
+	}
+
+	format := labelsFormat
+	if format == "auto" {
+		format = "keyvalue"
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+			format = "json"
 		}
-		defer file.Close()
+	}
+	if format == "json" {
+		return parseJSONLabels(data, labels)
+	}
+	return parseKeyValueLabels(data, labels)
+}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			pair := strings.Split(scanner.Text(), "=")
-			pair[1] = strings.ReplaceAll(pair[1], "\"", "")
-			podLabels[pair[0]] = pair[1]
+// parseKeyValueLabels parses labels of the form key="value", one on each line, into labels
+func parseKeyValueLabels(data []byte, labels map[string]string) (map[string]string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Values can contain an "=" themselves, lines without any aren't labels
+		pair := strings.SplitN(scanner.Text(), "=", 2)
+		if len(pair) != 2 {
+			continue
 		}
+		labels[pair[0]] = strings.ReplaceAll(pair[1], "\"", "")
+	}
 
-		if err := scanner.Err(); err != nil {
-			podLabels["error"] = fmt.Sprintf("ERROR: Error reading file: %++v", err)
+	if err := scanner.Err(); err != nil {
+		return labels, fmt.Errorf("ERROR: Error reading file: %++v", err)
+	}
+	return labels, nil
+}
+
+// parseJSONLabels parses labels from a json object into labels. Nested objects and arrays are flattened, joining
+// the keys with dots (e.g. {"app": {"tier": "web"}} becomes app.tier=web). Values which aren't strings are kept
+// in their json form.
+func parseJSONLabels(data []byte, labels map[string]string) (map[string]string, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return labels, fmt.Errorf("ERROR: Error json decoding file: %++v", err)
+	}
+	flattenLabels("", object, labels)
+	return labels, nil
+}
+
+// flattenLabels adds the (nested) json value under the key to labels
+func flattenLabels(key string, value interface{}, labels map[string]string) {
+	prefix := key
+	if prefix != "" {
+		prefix += "."
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, nested := range v {
+			flattenLabels(prefix+name, nested, labels)
+		}
+	case []interface{}:
+		for i, nested := range v {
+			flattenLabels(prefix+strconv.Itoa(i), nested, labels)
 		}
+	case string:
+		labels[key] = v
+	default:
+		encoded, _ := json.Marshal(v)
+		labels[key] = string(encoded)
 	}
+}
 
-	return podLabels
+// secretEnvironmentVariables are the env variables holding secrets which the server reads itself.
+// They are always masked, whatever the redact patterns are.
+var secretEnvironmentVariables = map[string]bool{
+	"REQUIRED_HEADER_VALUE": true,
+	"JWT_SECRET":            true,
+	"OUTBOUND_CLIENT_KEY":   true,
+}
+
+// isRedactedEnvironmentVariable returns whether the value of the env variable should be masked, because it is one of
+// the secretEnvironmentVariables or its name contains one of the redact patterns (case insensitive)
+func isRedactedEnvironmentVariable(name string) bool {
+	if secretEnvironmentVariables[name] {
+		return true
+	}
+	name = strings.ToUpper(name)
+	for _, pattern := range redactPatterns {
+		if strings.Contains(name, strings.ToUpper(pattern)) {
+			return true
+		}
+	}
+	return false
 }
 
+// getEnvironmentVariables returns the env variables of the process, with the values of the secrets the server reads
+// and of the ones matching the redact patterns (e.g. containing SECRET or TOKEN in their name) masked
 func getEnvironmentVariables() map[string]string {
+	environmentMutex.Lock()
+	defer environmentMutex.Unlock()
+
 	if environmentVariables == nil {
 		doFiltering := false
 		filterEnvVariables := []string{
@@ -107,7 +480,11 @@ func getEnvironmentVariables() map[string]string {
 		for _, e := range os.Environ() {
 			pair := strings.Split(e, "=")
 			if _, found := lookupMap[pair[0]]; !doFiltering || found {
-				environmentVariables[pair[0]] = pair[1]
+				if isRedactedEnvironmentVariable(pair[0]) {
+					environmentVariables[pair[0]] = "***"
+				} else {
+					environmentVariables[pair[0]] = pair[1]
+				}
 			}
 		}
 	}
@@ -121,15 +498,89 @@ func getServiceInfo(s *service) map[string]interface{} {
 		"currentTimestamp": time.Now().UTC(),
 		"environment":      getEnvironmentVariables(),
 		"labels":           getServiceLabels(),
+		"runtime":          getRuntimeStats(),
 	}
 }
 
+// getRuntimeStats returns some cheap to compute stats of the go runtime and the process
+func getRuntimeStats() map[string]interface{} {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+		"numCPU":     runtime.NumCPU(),
+		"goVersion":  runtime.Version(),
+		"uptime":     time.Since(processStartTime).String(),
+		"memory": map[string]interface{}{
+			"allocBytes":      memStats.Alloc,
+			"totalAllocBytes": memStats.TotalAlloc,
+			"sysBytes":        memStats.Sys,
+			"heapObjects":     memStats.HeapObjects,
+			"numGC":           memStats.NumGC,
+		},
+	}
+}
+
+// publicJWTClaims are the claims of a verified JWT which are included in the request info
+var publicJWTClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "scope"}
+
+// sortedValues returns a copy of the multi-valued map (e.g. headers or query params) with the values of each key
+// sorted, so the output doesn't depend on the order in which they were sent
+func sortedValues(values map[string][]string) map[string][]string {
+	sorted := make(map[string][]string, len(values))
+	for key, vs := range values {
+		sorted[key] = append([]string(nil), vs...)
+		sort.Strings(sorted[key])
+	}
+	return sorted
+}
+
+// getRequestHeaders returns the headers of the request, with their values sorted when STABLE_OUTPUT is set
+func getRequestHeaders(r *http.Request) map[string][]string {
+	if stableOutput {
+		return sortedValues(r.Header)
+	}
+	return r.Header
+}
+
+// getFormValues parses the url-encoded form in the body of the request, if the content type indicates one.
+// The body is read (at most formMaxBytes of it) and put back, so handlers can still read it after.
+func getFormValues(r *http.Request) (map[string][]string, error) {
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, formMaxBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > formMaxBytes {
+		return nil, fmt.Errorf("form larger than %v bytes", formMaxBytes)
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	if stableOutput {
+		form = sortedValues(form)
+	}
+	return form, nil
+}
+
 // getRequestInfo returns some info of the incoming request
 func getRequestInfo(r *http.Request) map[string]interface{} {
-	return map[string]interface{}{
-		"headers":    r.Header,
+	params := r.URL.Query()
+	if stableOutput {
+		// Deterministic output for snapshot testing, the keys are already sorted by the json encoding
+		params = sortedValues(params)
+	}
+	info := map[string]interface{}{
+		"headers":    getRequestHeaders(r),
 		"method":     r.Method,
-		"params":     r.URL.Query(),
+		"params":     params,
 		"remoteAddr": r.RemoteAddr,
 		"userAgent":  r.UserAgent(),
 		"url":        r.URL.String(),
@@ -137,32 +588,308 @@ func getRequestInfo(r *http.Request) map[string]interface{} {
 		"referrer":   r.Referer(),
 		"protocol":   r.Proto,
 	}
+
+	if form, err := getFormValues(r); err != nil {
+		info["formError"] = fmt.Sprintf("ERROR: Error parsing form: %v", err)
+	} else if form != nil {
+		info["form"] = form
+	}
+
+	if claims, ok := r.Context().Value(jwtClaimsContextKey).(jwt.MapClaims); ok {
+		publicClaims := make(map[string]interface{})
+		for _, name := range publicJWTClaims {
+			if value, found := claims[name]; found {
+				publicClaims[name] = value
+			}
+		}
+		info["jwtClaims"] = publicClaims
+	}
+	return info
+}
+
+// tlsVersionNames are the names of the TLS versions, as reported by the tlsHandler
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsCipherSuiteNames are the names of the cipher suites crypto/tls implements, as reported by the tlsHandler
+var tlsCipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// getTLSInfo returns the details of the TLS connection the request came in on: the negotiated version and cipher
+// suite, the server name sent with SNI and, with mutual TLS, the subject of the client certificate.
+// For plaintext requests (e.g. when TLS is terminated by a load balancer in front), nil is returned.
+func getTLSInfo(r *http.Request) map[string]interface{} {
+	if r.TLS == nil {
+		return nil
+	}
+	version, found := tlsVersionNames[r.TLS.Version]
+	if !found {
+		version = fmt.Sprintf("0x%04x", r.TLS.Version)
+	}
+	cipherSuite, found := tlsCipherSuiteNames[r.TLS.CipherSuite]
+	if !found {
+		cipherSuite = fmt.Sprintf("0x%04x", r.TLS.CipherSuite)
+	}
+	info := map[string]interface{}{
+		"version":            version,
+		"cipherSuite":        cipherSuite,
+		"serverName":         r.TLS.ServerName,
+		"negotiatedProtocol": r.TLS.NegotiatedProtocol,
+		"resumed":            r.TLS.DidResume,
+	}
+	if len(r.TLS.PeerCertificates) > 0 {
+		info["clientCertSubject"] = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	return info
+}
+
+// upstreamResult is the outcome of a call to an upstream, which can be shared by coalesced callers.
+// The body of the response is already read (in body) and closed.
+type upstreamResult struct {
+	resp       *http.Response
+	body       []byte
+	truncated  bool
+	readErr    error
+	retryAfter []string
+}
+
+// callUpstream performs a request with the method (without body) to the url and reads (at most maxResponseBytes of) the response body.
+// If debug is not nil, the outgoing request is captured in it.
+func callUpstream(ctx context.Context, method string, rawURL string, debug map[string]interface{}) (*upstreamResult, error) {
+	resp, retryAfter, err := doUpstream(ctx, method, rawURL, debug)
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+	body, truncated, err := readLimited(resp.Body, maxResponseBytes)
+	return &upstreamResult{resp: resp, body: body, truncated: truncated, readErr: err, retryAfter: retryAfter}, nil
+}
+
+// doUpstream performs a request with the method (without body) to the url, and returns the response with its body unread.
+// When the upstream responds with a 429 or 503 and a Retry-After header, the request is retried (at most
+// retryAfterMaxRetries times) after the requested time, capped at retryAfterMaxWait. The waits are returned in retryAfter.
+// If debug is not nil, the outgoing request is captured in it.
+func doUpstream(ctx context.Context, method string, rawURL string, debug map[string]interface{}) (resp *http.Response, retryAfter []string, err error) {
+	for attempt := 0; ; attempt++ {
+		// The outgoing request is bound to the incoming one, so it's cancelled when the client goes away
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			return nil, retryAfter, err
+		}
+		setDeadlineHeader(ctx, req)
+		if debug != nil {
+			debug["request"] = getDebugRequestInfo(req)
+		}
+		resp, err = DefaultHTTPClient.Do(req)
+		if err != nil {
+			return nil, retryAfter, err
+		}
+
+		wait, retry := retryAfterWait(resp, retryAfterMaxWait)
+		if !retry || attempt >= retryAfterMaxRetries {
+			return resp, retryAfter, nil
+		}
+		drainAndClose(resp.Body)
+		retryAfter = append(retryAfter, wait.String())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, retryAfter, ctx.Err()
+		}
+	}
+}
+
+// logOutboundCall logs a line with the details of an outbound call, tagged with the request id of the incoming request
+func logOutboundCall(ctx context.Context, method string, rawURL string, latency time.Duration, result *upstreamResult, err error) {
+	fields := []interface{}{"method", method, "url", rawURL, "latencyMs", latency.Nanoseconds() / int64(time.Millisecond)}
+	if result != nil {
+		fields = append(fields, "status", result.resp.StatusCode, "bytesRead", len(result.body))
+		if result.readErr != nil {
+			fields = append(fields, "error", result.readErr.Error())
+		}
+	}
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+	loggerFromContext(ctx).Infow("outbound call", fields...)
+}
+
+// checkOutboundCall handles the outcome of an outbound call in the same way for all kinds of calls: it logs the call,
+// records it for the circuit breaker (unless skipCircuitBreaker) and maps errors to the status of the response.
+// If the call failed, the status and message of the error to respond with are returned, otherwise the status is 0.
+func checkOutboundCall(r *http.Request, cb *circuitBreaker, method string, rawURL string, latency time.Duration, result *upstreamResult, err error, skipCircuitBreaker bool) (int, string) {
+	recordServerTiming(r.Context(), "upstream", latency)
+	logOutboundCall(r.Context(), method, rawURL, latency, result, err)
+	if r.Context().Err() == context.Canceled {
+		// Not the upstream's fault, so don't count it as a failure for the circuit breaker
+		return statusClientClosedRequest, "ERROR: request cancelled"
+	}
+	if errors.Is(err, errOutboundQueueTimeout) {
+		// Our own worker pool is saturated, which says nothing about the upstream
+		return http.StatusServiceUnavailable, fmt.Sprintf("ERROR: %v", errOutboundQueueTimeout)
+	}
+	if !skipCircuitBreaker {
+		recordCircuitBreaker(cb, result, err)
+	}
+	if err != nil {
+		return http.StatusBadGateway, fmt.Sprintf("ERROR: Error calling url %++v: %++v", rawURL, err)
+	}
+	return 0, ""
+}
+
+// recordCircuitBreaker records the outcome of an outbound call for the circuit breaker of its host.
+// Calls which didn't get a worker in time never reached the upstream, so they aren't recorded.
+func recordCircuitBreaker(cb *circuitBreaker, result *upstreamResult, err error) {
+	if errors.Is(err, errOutboundQueueTimeout) {
+		return
+	}
+	var resp *http.Response
+	if result != nil {
+		resp = result.resp
+	}
+	cb.record(!isUpstreamFailure(resp, err))
 }
 
 // getJSONResponse performs a call to an external call, expecting a json response and returns a map with
 // that json response in it under the key "response". If no json could be decoded, the "response_raw" key will
-// contain a string with the received body of the request.
+// contain a string with the received body of the request. Bodies larger than maxResponseBytes are
+// truncated, which is indicated by the "truncated" key. When debugging is allowed and the "debug=1" param is given,
+// the full upstream request and response are included under the "debug" key.
 func getJSONResponse(r *http.Request) map[string]interface{} {
 	// Perform external call
 	called := make(map[string]interface{})
-	urlParams, ok := r.URL.Query()["url"]
-	if !ok || len(urlParams) != 1 || len(urlParams[0]) < 1 {
-		called["error"] = "ERROR: Invalid url param provided for url to call"
+	// A url given more than once is rejected by the callParamRules before getting here
+	urlParams := r.URL.Query()["url"]
+	if len(urlParams) == 0 || len(urlParams[0]) < 1 {
+		setJSONError(called, http.StatusBadRequest, "ERROR: No url param provided for url to call")
 	} else {
 		called["url"] = urlParams[0]
-		resp, err := DefaultHTTPClient.Get(urlParams[0])
+		u, err := validateOutboundURL(urlParams[0])
 		if err != nil {
-			called["error"] = fmt.Sprintf("ERROR: Error calling url %++v: %++v", urlParams[0], err)
+			setJSONError(called, http.StatusBadRequest, fmt.Sprintf("ERROR: %v", err))
+			return called
+		}
+		host := u.Host
+		cb := getCircuitBreaker(host)
+		defer func() {
+			called["circuitBreaker"] = cb.info()
+		}()
+		if !cb.allow() {
+			setJSONError(called, http.StatusServiceUnavailable, fmt.Sprintf("ERROR: circuit_open: too many consecutive failures calling host %v", host))
+			return called
+		}
+
+		// Capture the full upstream request and response for debugging, if allowed and requested
+		var debug map[string]interface{}
+		if allowDebug && r.URL.Query().Get("debug") == "1" {
+			debug = make(map[string]interface{})
+			called["debug"] = debug
+		}
+
+		// Identical concurrent calls share a single outbound call, unless the request is captured for debugging
+		method, timeout := getCallOptions(r)
+		ctx, cancel := callContext(r.Context(), timeout)
+		defer cancel()
+		if method != http.MethodGet {
+			called["method"] = method
+		}
+		var result *upstreamResult
+		// Context errors which aren't caused by the upstream don't count for the circuit breaker,
+		// and shared calls are recorded once by the call itself rather than by each of its callers
+		skipCircuitBreaker := false
+		start := time.Now()
+		if debug != nil || !coalesceCalls {
+			result, err = callUpstream(ctx, method, urlParams[0], debug)
+			recordOutboundRequest(method, time.Since(start), result, err)
 		} else {
-			defer resp.Body.Close()
-			body, err := ioutil.ReadAll(resp.Body)
+			// The shared call must not inherit the cancellation or timeout of whichever caller happens to start it,
+			// so it runs detached from the request (but still in its trace), bound by the timeout which is part of the key
+			sharedTimeout := timeout
+			if sharedTimeout == 0 {
+				sharedTimeout = requestTimeoutDuration
+			}
+			calls := coalescedCalls.DoChan(method+" "+urlParams[0]+" "+sharedTimeout.String(), func() (interface{}, error) {
+				sharedCtx, cancel := callContext(trace.NewContext(context.Background(), trace.FromContext(r.Context())), sharedTimeout)
+				defer cancel()
+				// The call is recorded once, not by each of the callers sharing it. Hitting the shared timeout
+				// means the upstream hangs, so unlike a caller's own cancellation it counts as a failure.
+				result, err := callUpstream(sharedCtx, method, urlParams[0], nil)
+				recordOutboundRequest(method, time.Since(start), result, err)
+				recordCircuitBreaker(cb, result, err)
+				return result, err
+			})
+			skipCircuitBreaker = true
+			select {
+			case shared := <-calls:
+				result, _ = shared.Val.(*upstreamResult)
+				err = shared.Err
+				if shared.Shared {
+					called["coalesced"] = true
+				}
+			case <-ctx.Done():
+				// The caller's own cancellation or timeout, while waiting for the shared call
+				err = ctx.Err()
+			}
+		}
+		if result != nil && len(result.retryAfter) > 0 {
+			called["retryAfter"] = result.retryAfter
+		}
+		if status, message := checkOutboundCall(r, cb, method, urlParams[0], time.Since(start), result, err, skipCircuitBreaker); status != 0 {
+			setJSONError(called, status, message)
+		} else {
+			resp := result.resp
+			body, truncated, err := result.body, result.truncated, result.readErr
+			if err == nil && !truncated {
+				// A compressed body which is only partly read can't be decompressed, so it's returned raw below
+				body, truncated, err = decodeContentEncoding(resp, body, maxResponseBytes)
+			}
+			if debug != nil {
+				debug["response"] = getDebugResponseInfo(resp, body)
+			}
 			if err != nil {
-				called["error"] = fmt.Sprintf("ERROR: Error reading response body: %++v", err)
+				setJSONError(called, http.StatusBadGateway, fmt.Sprintf("ERROR: Error reading response body: %++v", err))
+			} else if truncated {
+				// The body can't be decoded as json when only a part of it is read, so return it raw
+				called["truncated"] = true
+				called["response_raw"] = string(body)
 			} else {
 				var target interface{}
 				err = json.Unmarshal(body, &target)
 				if err != nil {
-					called["error"] = fmt.Sprintf("ERROR: Error json decoding response body: %++v", err)
+					setJSONError(called, http.StatusBadGateway, fmt.Sprintf("ERROR: Error json decoding response body: %++v", err))
 					called["response_raw"] = string(body)
 				} else {
 					called["response"] = target
@@ -174,31 +901,874 @@ func getJSONResponse(r *http.Request) map[string]interface{} {
 	return called
 }
 
+// applyRequestedDelay sleeps for the duration given in the "delay" query param (e.g. "250ms"), capped at maxDelay.
+// The sleep is cut short when the request is cancelled or times out. If it returns false, the delay was invalid or
+// interrupted and an error response has been written.
+func applyRequestedDelay(w http.ResponseWriter, r *http.Request) bool {
+	delayParam := r.URL.Query().Get("delay")
+	if delayParam == "" {
+		return true
+	}
+	delay, err := time.ParseDuration(delayParam)
+	if err != nil || delay < 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid delay param %q, expected a duration like 250ms", delayParam))
+		return false
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("ERROR: Request ended during delay: %v", r.Context().Err()))
+		return false
+	}
+}
+
 // indexHandler returns a json with some info about the service, the request headers, the environment
 func (s *service) indexHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
+		if !negotiate(w, r, "application/json") {
+			return
+		}
+		if !applyRequestedDelay(w, r) {
+			return
+		}
 		response := make(map[string]interface{})
 		response["service"] = getServiceInfo(s)
 		response["request"] = getRequestInfo(r)
 
-		json.NewEncoder(w).Encode(response)
+		writeJSON(w, r, http.StatusOK, response)
 	}
 }
 
-// callHandler calls a url given in the getparam and returns the json as in the indexHandler above, with the info of the call
-func (s *service) callHandler() http.HandlerFunc {
+// headersHandler returns only the request headers, for a quick inspection of what arrives through proxies
+func (s *service) headersHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"headers": getRequestHeaders(r)})
+	}
+}
+
+// tlsHandler returns the details of the TLS connection of the request, or null for plaintext requests
+func (s *service) tlsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"tls": getTLSInfo(r)})
+	}
+}
+
+// callMethods are the methods which can be used for the calls made by the callHandler, which don't send a body
+var callMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// callParamRules are the query params accepted by the callHandler
+var callParamRules = []paramRule{
+	{name: "url", required: true, validate: func(value string) error {
+		_, err := validateOutboundURL(value)
+		return err
+	}},
+	{name: "method", validate: func(value string) error {
+		if !callMethods[strings.ToUpper(value)] {
+			return fmt.Errorf("%q is not one of GET, HEAD, DELETE or OPTIONS", value)
+		}
+		return nil
+	}},
+	{name: "timeout", validate: func(value string) error {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 || timeout > requestTimeoutDuration {
+			return fmt.Errorf("%q is not a duration up to %v", value, requestTimeoutDuration)
+		}
+		return nil
+	}},
+}
+
+// getCallOptions returns the method (GET by default) and the timeout (0 if not given) of the call to make by
+// the callHandler. The params are validated by callParamRules.
+func getCallOptions(r *http.Request) (string, time.Duration) {
+	method := http.MethodGet
+	if value := r.URL.Query().Get("method"); value != "" {
+		method = strings.ToUpper(value)
+	}
+	timeout, _ := time.ParseDuration(r.URL.Query().Get("timeout"))
+	return method, timeout
+}
+
+// callContext returns the context of a call, bound by the timeout if it's not 0.
+// The cancel function must be called once the call is done.
+func callContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// isContextError returns whether the error is caused by a cancelled or expired context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
 
+// streamUpstream calls the url given in the url param, and copies the upstream response (status, content type and body)
+// to the client as it arrives, flushing after every chunk, so streaming upstreams (e.g. SSE) aren't buffered
+func streamUpstream(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	u, err := validateOutboundURL(rawURL)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: %v", err))
+		return
+	}
+	cb := getCircuitBreaker(u.Host)
+	if !cb.allow() {
+		writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("ERROR: circuit_open: too many consecutive failures calling host %v", u.Host))
+		return
+	}
+
+	method, timeout := getCallOptions(r)
+	ctx, cancel := callContext(r.Context(), timeout)
+	defer cancel()
+	start := time.Now()
+	resp, retryAfter, err := doUpstream(ctx, method, rawURL, nil)
+	// The body isn't read yet, so only the time until the response headers is recorded
+	var result *upstreamResult
+	if resp != nil {
+		result = &upstreamResult{resp: resp, retryAfter: retryAfter}
+		defer drainAndClose(resp.Body)
+	}
+	recordOutboundRequest(method, time.Since(start), result, err)
+	if len(retryAfter) > 0 {
+		w.Header().Set("X-Retry-After-Waits", strings.Join(retryAfter, ", "))
+	}
+	if status, message := checkOutboundCall(r, cb, method, rawURL, time.Since(start), result, err, false); status != 0 {
+		writeJSONError(w, status, message)
+		return
+	}
+
+	// The headers set by the middleware (e.g. the trace id) take precedence over the ones of the upstream
+	for name, values := range sanitizeForwardedHeaders(resp.Header, forwardedHeadersMaxSize) {
+		if _, found := w.Header()[name]; !found {
+			w.Header()[name] = values
+		}
+	}
+	if method == http.MethodHead {
+		// There is no body to match the length of the upstream's response
+		w.Header().Del("Content-Length")
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, err := w.Write(buffer[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				loggerFromContext(r.Context()).Debugf("streaming the response of %v failed: %v", rawURL, err)
+			}
+			return
+		}
+	}
+}
+
+// callHandler calls a url given in the getparam and returns the json as in the indexHandler above, with the info of the call.
+// With "stream=1", the upstream response is streamed to the client as is instead.
+func (s *service) callHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") == "1" {
+			streamUpstream(w, r)
+			return
+		}
 		response := make(map[string]interface{})
 		response["service"] = getServiceInfo(s)
 		response["request"] = getRequestInfo(r)
-		response["called"] = getJSONResponse(r)
+		called := getJSONResponse(r)
+		response["called"] = called
+		loggerFromContext(r.Context()).Debugw("called upstream", "url", called["url"], "error", called["error"])
+
+		writeJSON(w, r, http.StatusOK, response)
+	}
+}
+
+// listRoutes returns the path templates and methods of all routes registered on the router
+func listRoutes(router *mux.Router) ([]map[string]interface{}, error) {
+	routes := make([]map[string]interface{}, 0)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		pathTemplate, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{}
+		}
+		routes = append(routes, map[string]interface{}{
+			"path":    pathTemplate,
+			"methods": methods,
+		})
+		return nil
+	})
+	return routes, err
+}
+
+// landingPageTemplate is the html page served at the root path in the html root mode
+var landingPageTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.name}}</title></head>
+<body>
+<h1>{{.name}}</h1>
+<p>The info about this request and the server as json is available at <a href="{{.prefix}}/info">/info</a>.</p>
+<h2>Endpoints</h2>
+<ul>
+{{range .routes}}<li><a href="{{$.prefix}}{{.path}}">{{.path}}</a>{{if .methods}} ({{range $i, $m := .methods}}{{if $i}}, {{end}}{{$m}}{{end}}){{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// landingPageHandler returns a small html page listing the endpoints registered on the router
+func (s *service) landingPageHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		routes, err := listRoutes(router)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ERROR: Error listing routes: %++v", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		landingPageTemplate.Execute(w, map[string]interface{}{
+			"name":   s.name,
+			"prefix": strings.TrimSuffix(pathPrefix, "/"),
+			"routes": routes,
+		})
+	}
+}
+
+// routesHandler returns a json listing all routes registered on the router, with their path templates and methods
+func (s *service) routesHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		routes, err := listRoutes(router)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ERROR: Error listing routes: %++v", err))
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"routes": routes})
+	}
+}
+
+// matchParamRules are the query params accepted by the matchHandler
+var matchParamRules = []paramRule{
+	{name: "path", required: true, validate: func(value string) error {
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf("%q is not a path starting with /", value)
+		}
+		return nil
+	}},
+	{name: "method"},
+}
+
+// matchHandler reports which route of the router the "path" param matches, for a request with the "method" param
+// (GET by default), along with its path variables and allowed methods. The params are validated by matchParamRules.
+func (s *service) matchHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		method := http.MethodGet
+		if value := r.URL.Query().Get("method"); value != "" {
+			method = strings.ToUpper(value)
+		}
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid path %q: %v", path, err))
+			return
+		}
+
+		result := map[string]interface{}{"path": path, "method": method, "matched": false}
+		var match mux.RouteMatch
+		if router.Match(req, &match) && match.MatchErr == nil {
+			pathTemplate, _ := match.Route.GetPathTemplate()
+			methods, err := match.Route.GetMethods()
+			if err != nil {
+				methods = []string{}
+			}
+			vars := match.Vars
+			if vars == nil {
+				vars = map[string]string{}
+			}
+			result["matched"] = true
+			result["route"] = pathTemplate
+			result["vars"] = vars
+			result["methods"] = methods
+		} else if match.MatchErr == mux.ErrMethodMismatch {
+			result["reason"] = fmt.Sprintf("a route matches the path, but not the method %v", method)
+		} else {
+			result["reason"] = "no route matches the path"
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// webSocketRegistry keeps track of the open WebSocket connections, which aren't closed by the server shutdown
+// as they are hijacked from it
+type webSocketRegistry struct {
+	mutex       sync.Mutex
+	connections map[*websocket.Conn]struct{}
+}
+
+// openWebSockets holds the WebSocket connections of the /ws endpoint, closed during the graceful shutdown
+var openWebSockets = &webSocketRegistry{connections: make(map[*websocket.Conn]struct{})}
+
+func (wr *webSocketRegistry) add(conn *websocket.Conn) {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	wr.connections[conn] = struct{}{}
+}
+
+func (wr *webSocketRegistry) remove(conn *websocket.Conn) {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	delete(wr.connections, conn)
+}
+
+func (wr *webSocketRegistry) count() int {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	return len(wr.connections)
+}
+
+// closeAll sends a close frame to all open connections, and waits at most the grace period for the clients
+// to close them, after which the remaining connections are closed abruptly
+func (wr *webSocketRegistry) closeAll(gracePeriod time.Duration) {
+	deadline := time.Now().Add(gracePeriod)
+	wr.mutex.Lock()
+	for conn := range wr.connections {
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		conn.WriteControl(websocket.CloseMessage, message, deadline)
+	}
+	wr.mutex.Unlock()
+
+	for wr.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	for conn := range wr.connections {
+		conn.Close()
+	}
+}
+
+// wsEchoHandler upgrades the connection to a WebSocket and echoes back every message it receives.
+// The connection is closed when no message is received within wsReadTimeout.
+func (s *service) wsEchoHandler() http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		// Allow any origin, as this is an inspection tool to test proxies and load balancers with
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestLogger := loggerFromContext(r.Context())
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already responded with an error
+			requestLogger.Warnf("failed to upgrade websocket connection from %v: %v", r.RemoteAddr, err)
+			return
+		}
+		defer conn.Close()
+		openWebSockets.add(conn)
+		defer openWebSockets.remove(conn)
+		requestLogger.Infof("websocket connected from %v", r.RemoteAddr)
+
+		conn.SetReadLimit(wsMaxMessageBytes)
+		for {
+			conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					requestLogger.Debugf("websocket read from %v failed: %v", r.RemoteAddr, err)
+				}
+				break
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				requestLogger.Debugf("websocket write to %v failed: %v", r.RemoteAddr, err)
+				break
+			}
+		}
+		requestLogger.Infof("websocket disconnected from %v", r.RemoteAddr)
+	}
+}
+
+// statusHandler responds with the status code given in the path, along with a small json body describing it
+func (s *service) statusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		codeParam := mux.Vars(r)["code"]
+		code, err := strconv.Atoi(codeParam)
+		if err != nil || code < 100 || code > 599 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid status code %q, expected a number between 100 and 599", codeParam))
+			return
+		}
+
+		writeJSON(w, r, code, map[string]interface{}{
+			"status":     code,
+			"statusText": http.StatusText(code),
+		})
+	}
+}
+
+// mockResponse is the template of the response returned by the mockHandler, which can be posted as json
+type mockResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    interface{}       `json:"body"`
+}
+
+// mockHandler returns a configurable response for mocking upstreams in integration tests. The response is described
+// by a json template posted in the body ({"status", "headers", "body"}) and/or the "status", "header" (as Name:Value,
+// can be repeated) and "delay" params, the params taking precedence. Without a body in the template, the response
+// echoes the request info.
+func (s *service) mockHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mock := mockResponse{Status: http.StatusOK}
+		if r.Method == http.MethodPost && r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, requestSpecMaxBytes)).Decode(&mock); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid mock template: %++v", err))
+				return
+			}
+		}
+
+		query := r.URL.Query()
+		if statusParam := query.Get("status"); statusParam != "" {
+			status, err := strconv.Atoi(statusParam)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid status code %q, expected a number between 100 and 599", statusParam))
+				return
+			}
+			mock.Status = status
+		}
+		if mock.Status < 100 || mock.Status > 599 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid status code %v, expected a number between 100 and 599", mock.Status))
+			return
+		}
+		headers := make(map[string]string)
+		for name, value := range mock.Headers {
+			headers[name] = value
+		}
+		for _, header := range query["header"] {
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid header param %q, expected Name:Value", header))
+				return
+			}
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+
+		if !applyRequestedDelay(w, r) {
+			return
+		}
+
+		body := mock.Body
+		if body == nil {
+			body = map[string]interface{}{
+				"status":  mock.Status,
+				"request": getRequestInfo(r),
+			}
+		}
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		writeJSON(w, r, mock.Status, body)
+	}
+}
+
+// bytesHandler streams the number of bytes given in the path, in chunks, for bandwidth testing.
+// The data consists of zeroes, or random bytes when the "random=1" param is given.
+func (s *service) bytesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nParam := mux.Vars(r)["n"]
+		n, err := strconv.ParseInt(nParam, 10, 64)
+		if err != nil || n < 0 || n > maxBytes {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid number of bytes %q, expected a number between 0 and %v", nParam, maxBytes))
+			return
+		}
+		random := r.URL.Query().Get("random") == "1"
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		w.WriteHeader(http.StatusOK)
+
+		chunk := make([]byte, 32<<10)
+		for remaining := n; remaining > 0; {
+			if r.Context().Err() != nil {
+				return
+			}
+			size := int64(len(chunk))
+			if remaining < size {
+				size = remaining
+			}
+			if random {
+				rand.Read(chunk[:size])
+			}
+			if _, err := w.Write(chunk[:size]); err != nil {
+				return
+			}
+			remaining -= size
+		}
+	}
+}
+
+// dripParamRules are the query params accepted by the dripHandler, besides the delay handled by applyRequestedDelay
+var dripParamRules = []paramRule{
+	{name: "numbytes", validate: func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || n > maxBytes {
+			return fmt.Errorf("%q is not a number between 0 and %v", value, maxBytes)
+		}
+		return nil
+	}},
+	{name: "duration", validate: func(value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 || duration > maxDelay {
+			return fmt.Errorf("%q is not a duration up to %v", value, maxDelay)
+		}
+		return nil
+	}},
+}
+
+// dripSteps is the maximum number of writes the dripHandler spreads the bytes over
+const dripSteps = 100
+
+// dripHandler writes numbytes bytes (10 by default) spread evenly over the duration (2s by default), flushing each
+// write, after the initial delay. It's meant for testing read timeouts and progress handling of clients.
+// The params are validated by dripParamRules.
+func (s *service) dripHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := int64(10)
+		if value := r.URL.Query().Get("numbytes"); value != "" {
+			n, _ = strconv.ParseInt(value, 10, 64)
+		}
+		duration := 2 * time.Second
+		if value := r.URL.Query().Get("duration"); value != "" {
+			duration, _ = time.ParseDuration(value)
+		}
+		if !applyRequestedDelay(w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+
+		steps := n
+		if steps > dripSteps {
+			steps = dripSteps
+		}
+		if steps == 0 {
+			return
+		}
+		interval := duration / time.Duration(steps)
+		// The remainder of the division of the bytes over the steps goes to the first writes
+		for step := int64(0); step < steps; step++ {
+			timer := time.NewTimer(interval)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+			size := n / steps
+			if step < n%steps {
+				size++
+			}
+			if _, err := w.Write(bytes.Repeat([]byte("*"), int(size))); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// noListingFileSystem is a http.FileSystem which refuses to open directories without an index.html,
+// so the file server doesn't list their contents
+type noListingFileSystem struct {
+	fs http.FileSystem
+}
+
+func (nfs noListingFileSystem) Open(name string) (http.File, error) {
+	f, err := nfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := f.Stat(); err == nil && stat.IsDir() {
+		index, err := nfs.fs.Open(strings.TrimSuffix(name, "/") + "/index.html")
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// staticHandler serves the files in the given directory. http.Dir confines the served files to the directory,
+// guarding against path traversal. Directory listings are only served if allowed.
+func staticHandler(dir string, allowListing bool) http.Handler {
+	var fs http.FileSystem = http.Dir(dir)
+	if !allowListing {
+		fs = noListingFileSystem{fs}
+	}
+	return http.FileServer(fs)
+}
+
+// rawHandler returns the incoming request as raw text, as it was received: the request line, headers and
+// (at most rawMaxBodyBytes of) the body
+func (s *service) rawHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = ioutil.NopCloser(io.LimitReader(r.Body, rawMaxBodyBytes))
+		dump, err := httputil.DumpRequest(r, true)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ERROR: Error dumping request: %++v", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(dump)
+	}
+}
+
+// recentHandler returns a json with the most recent requests handled by the server
+func (s *service) recentHandler(rr *requestRing) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"requests": rr.list()})
+	}
+}
+
+// depsHandler returns a json with the versions of the modules the binary was built with, from its build info.
+// The build info isn't available in all builds, which is indicated by the "available" key.
+func (s *service) depsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"goVersion":    runtime.Version(),
+			"available":    false,
+			"dependencies": map[string]string{},
+		}
+
+		if buildInfo, ok := debug.ReadBuildInfo(); ok {
+			dependencies := make(map[string]string)
+			for _, dep := range buildInfo.Deps {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				dependencies[dep.Path] = dep.Version
+			}
+			response["available"] = true
+			response["main"] = map[string]string{"path": buildInfo.Main.Path, "version": buildInfo.Main.Version}
+			response["dependencies"] = dependencies
+		}
+
+		writeJSON(w, r, http.StatusOK, response)
+	}
+}
+
+// outboundRequestSpec describes an outgoing request to be made by the requestHandler
+type outboundRequestSpec struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Timeout string            `json:"timeout"`
+}
+
+// allowedOutboundMethods are the methods which can be used in an outboundRequestSpec
+var allowedOutboundMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// newRequest validates the spec and builds the request it describes, bound to the given context.
+// The returned cancel function must be called once the request is done.
+func (spec outboundRequestSpec) newRequest(ctx context.Context) (*http.Request, context.CancelFunc, error) {
+	method := strings.ToUpper(spec.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !allowedOutboundMethods[method] {
+		return nil, nil, fmt.Errorf("invalid method %q", spec.Method)
+	}
+	if _, err := validateOutboundURL(spec.URL); err != nil {
+		return nil, nil, err
+	}
+	timeout := requestTimeoutDuration
+	if spec.Timeout != "" {
+		value, err := time.ParseDuration(spec.Timeout)
+		if err != nil || value <= 0 || value > requestTimeoutDuration {
+			return nil, nil, fmt.Errorf("invalid timeout %q, expected a duration up to %v", spec.Timeout, requestTimeoutDuration)
+		}
+		timeout = value
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	req, err := http.NewRequestWithContext(ctx, method, spec.URL, strings.NewReader(spec.Body))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	for name, value := range spec.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, cancel, nil
+}
+
+// requestHandler performs the outgoing request described by the json spec in the request body
+// ({"method", "url", "headers", "body", "timeout"}), and returns the upstream status, headers and body.
+func (s *service) requestHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var spec outboundRequestSpec
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, requestSpecMaxBytes)).Decode(&spec); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid request spec: %++v", err))
+			return
+		}
+		req, cancel, err := spec.newRequest(r.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid request spec: %++v", err))
+			return
+		}
+		defer cancel()
+		setDeadlineHeader(req.Context(), req)
+
+		resp, err := DefaultHTTPClient.Do(req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("ERROR: Error calling url %++v: %++v", spec.URL, err))
+			return
+		}
+		defer drainAndClose(resp.Body)
+		body, truncated, err := readLimited(resp.Body, maxResponseBytes)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("ERROR: Error reading response body: %++v", err))
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"url":        spec.URL,
+			"method":     req.Method,
+			"statusCode": resp.StatusCode,
+			"headers":    resp.Header,
+			"body":       string(body),
+			"truncated":  truncated,
+		})
+	}
+}
+
+// logLevelHandler changes the log level at runtime to the one in the json body ({"level": "debug"}),
+// as a friendlier alternative to sending SIGHUP into the container. It returns the new level.
+func (s *service) logLevelHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid json body: %++v", err))
+			return
+		}
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(body.Level)); err != nil || body.Level == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Unknown log level %q, expected one of debug, info, warn, error, dpanic, panic, fatal", body.Level))
+			return
+		}
+		atomicLogLevel.SetLevel(level)
+		loggerFromContext(r.Context()).Warnf("log level changed to %v via the admin endpoint", level)
+
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"level": level.String()})
+	}
+}
+
+// isValidHostname returns whether the host looks like a hostname or ip address which can be looked up
+func isValidHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsHandler resolves the host given in the "host" param, and returns its addresses. With "srv=1", the SRV records
+// of the host are looked up as well. The lookups are bound by dnsLookupTimeout and the request context.
+func (s *service) dnsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("host")
+		if !isValidHostname(host) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid host param %q, expected a hostname like service.namespace.svc.cluster.local", host))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), dnsLookupTimeout)
+		defer cancel()
+
+		start := time.Now()
+		response := map[string]interface{}{"host": host}
+		addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("ERROR: Error resolving host %v: %++v", host, err))
+			return
+		}
+		response["addresses"] = addresses
+
+		if r.URL.Query().Get("srv") == "1" {
+			_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", host)
+			if err != nil {
+				response["srvError"] = err.Error()
+			} else {
+				srv := make([]map[string]interface{}, 0, len(records))
+				for _, record := range records {
+					srv = append(srv, map[string]interface{}{
+						"target":   record.Target,
+						"port":     record.Port,
+						"priority": record.Priority,
+						"weight":   record.Weight,
+					})
+				}
+				response["srv"] = srv
+			}
+		}
+		response["durationMs"] = millisecondsSince(start)
+
+		writeJSON(w, r, http.StatusOK, response)
+	}
+}
+
+// fdsHandler returns the number of open file descriptors of the process and its limits, to debug leaks
+// (e.g. connections of the outbound client which aren't closed). The count is read from /proc/self/fd,
+// which only exists on Linux, elsewhere only the limits are returned (if the platform has them).
+func (s *service) fdsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := make(map[string]interface{})
+		if entries, err := ioutil.ReadDir("/proc/self/fd"); err != nil {
+			response["openError"] = err.Error()
+		} else {
+			response["open"] = len(entries)
+		}
+
+		if soft, hard, err := fileDescriptorLimits(); err != nil {
+			response["limitError"] = err.Error()
+		} else {
+			response["softLimit"] = soft
+			response["hardLimit"] = hard
+		}
 
-		json.NewEncoder(w).Encode(response)
+		writeJSON(w, r, http.StatusOK, response)
 	}
 }
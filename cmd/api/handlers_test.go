@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// callRequest returns an incoming request for the /call/ endpoint, calling the given url
+func callRequest(rawURL string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/call/?url="+url.QueryEscape(rawURL), nil)
+}
+
+func TestGetJSONResponseLimitsBody(t *testing.T) {
+	defer func(limit int64) { maxResponseBytes = limit }(maxResponseBytes)
+	maxResponseBytes = 16
+
+	tests := []struct {
+		name      string
+		body      string
+		truncated bool
+		raw       string
+	}{
+		{"within limit", `{"ok": true}`, false, ""},
+		{"exactly the limit", `{"name": "abcd"}`, false, ""},
+		{"over the limit", `{"name": "abcdefghijklmnopqrstuvwxyz"}`, true, `{"name": "abcdef`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+
+			called := getJSONResponse(callRequest(upstream.URL))
+			if called["error"] != nil {
+				t.Fatalf("unexpected error %v", called["error"])
+			}
+			if truncated := called["truncated"] == true; truncated != tt.truncated {
+				t.Errorf("truncated = %v, expected %v", truncated, tt.truncated)
+			}
+			if tt.truncated {
+				if called["response_raw"] != tt.raw {
+					t.Errorf("response_raw = %q, expected %q", called["response_raw"], tt.raw)
+				}
+			} else if called["response"] == nil {
+				t.Errorf("missing decoded response in %v", called)
+			}
+		})
+	}
+}
+
+func TestGetJSONResponseStreamingBody(t *testing.T) {
+	defer func(limit int64) { maxResponseBytes = limit }(maxResponseBytes)
+	maxResponseBytes = 1 << 10
+
+	// An upstream which never stops writing must not make the call hang or read it all
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := []byte(strings.Repeat("x", 512))
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	called := getJSONResponse(callRequest(upstream.URL))
+	if called["truncated"] != true {
+		t.Fatalf("endless body wasn't truncated: %v", called["error"])
+	}
+	if raw, _ := called["response_raw"].(string); len(raw) != 1<<10 {
+		t.Errorf("response_raw has %v bytes, expected %v", len(raw), 1<<10)
+	}
+}
+
+func TestGetServiceLabelsRetriesFailedReads(t *testing.T) {
+	if IsDevelopment() {
+		t.Skip("the labels are read from a fixed file in development")
+	}
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string, format string, interval time.Duration) {
+		podLabelsFile, labelsFormat, labelsRetryInterval = file, format, interval
+		podLabels, podLabelsFailure = nil, nil
+	}(podLabelsFile, labelsFormat, labelsRetryInterval)
+	podLabelsFile, labelsFormat = filepath.Join(dir, "labels"), "json"
+	podLabels, podLabelsFailure = nil, nil
+
+	// Each step rewrites the file and reads the labels again, which depends on what the previous steps cached
+	steps := []struct {
+		name          string
+		contents      string
+		retryInterval time.Duration
+		app           string
+		failed        bool
+	}{
+		{"failed read", `{"app": `, time.Hour, "", true},
+		{"failure cached within retry interval", `{"app": "web"}`, time.Hour, "", true},
+		{"retried after retry interval", `{"app": "web"}`, 0, "web", false},
+		{"success cached", `{"app": `, 0, "web", false},
+	}
+	for _, step := range steps {
+		if err := ioutil.WriteFile(podLabelsFile, []byte(step.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		labelsRetryInterval = step.retryInterval
+		labels := getServiceLabels()
+		if _, failed := labels["error"]; failed != step.failed || labels["app"] != step.app {
+			t.Errorf("%v: labels %v, expected app %q and failed %v", step.name, labels, step.app, step.failed)
+		}
+	}
+}
+
+func TestGetJSONResponseCancelled(t *testing.T) {
+	defer func(coalesce bool) { coalesceCalls = coalesce }(coalesceCalls)
+
+	for _, coalesce := range []bool{false, true} {
+		coalesceCalls = coalesce
+		received := make(chan struct{})
+		upstreamCancelled := make(chan struct{})
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(received)
+			select {
+			case <-r.Context().Done():
+				close(upstreamCancelled)
+			case <-release:
+			}
+		}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-received
+			cancel()
+		}()
+		called := getJSONResponse(callRequest(upstream.URL).WithContext(ctx))
+		if called["status"] != statusClientClosedRequest || called["error"] != "ERROR: request cancelled" {
+			t.Errorf("coalesce %v: got status %v and error %v, expected a cancelled request", coalesce, called["status"], called["error"])
+		}
+		if breaker, _ := called["circuitBreaker"].(map[string]interface{}); breaker["consecutiveFailures"] != 0 {
+			t.Errorf("coalesce %v: the cancellation counted as failure for the circuit breaker: %v", coalesce, breaker)
+		}
+		if !coalesce {
+			// The outbound call is bound to the incoming request
+			select {
+			case <-upstreamCancelled:
+			case <-time.After(5 * time.Second):
+				t.Errorf("the outbound call wasn't cancelled along with the incoming request")
+			}
+		}
+		close(release)
+		upstream.Close()
+	}
+}
+
+func TestCoalescedCallsCircuitBreaker(t *testing.T) {
+	defer func(coalesce bool, threshold int, timeout time.Duration) {
+		coalesceCalls, circuitBreakerThreshold, requestTimeoutDuration = coalesce, threshold, timeout
+	}(coalesceCalls, circuitBreakerThreshold, requestTimeoutDuration)
+	coalesceCalls = true
+	circuitBreakerThreshold = 3
+	requestTimeoutDuration = 200 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		status int
+		hang   bool
+	}{
+		{"server error", http.StatusInternalServerError, false},
+		{"hanging upstream", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			release := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if tt.hang {
+					<-r.Context().Done()
+					return
+				}
+				<-release
+				w.WriteHeader(tt.status)
+			}))
+			defer upstream.Close()
+
+			// Give all callers the time to join the shared call before it completes
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(release)
+			}()
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					getJSONResponse(callRequest(upstream.URL))
+				}()
+			}
+			wg.Wait()
+
+			u, _ := url.Parse(upstream.URL)
+			breaker := getCircuitBreaker(u.Host).info()
+			// Every outbound call which was made counts once, however many callers shared it
+			if breaker["consecutiveFailures"] != int(atomic.LoadInt32(&calls)) || breaker["state"] != "closed" {
+				t.Errorf("circuit breaker %v after %v outbound calls, expected a closed breaker with a failure per call", breaker, calls)
+			}
+		})
+	}
+}
+
+func TestGetEnvironmentVariablesRedaction(t *testing.T) {
+	defer func(patterns []string) {
+		redactPatterns = patterns
+		environmentVariables = nil
+	}(redactPatterns)
+	env := map[string]string{
+		"REQUIRED_HEADER_VALUE": "shared-secret",
+		"JWT_SECRET":            "signing-secret",
+		"OUTBOUND_CLIENT_KEY":   "/etc/tls/client.key",
+		"API_TEST_DB_PASSWORD":  "hunter2",
+		"API_TEST_REGION":       "europe-west1",
+	}
+	for name, value := range env {
+		defer os.Unsetenv(name)
+		os.Setenv(name, value)
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		masked   []string
+	}{
+		{"default patterns", []string{"SECRET", "TOKEN", "PASSWORD", "KEY"}, []string{"REQUIRED_HEADER_VALUE", "JWT_SECRET", "OUTBOUND_CLIENT_KEY", "API_TEST_DB_PASSWORD"}},
+		{"custom patterns", []string{"region"}, []string{"REQUIRED_HEADER_VALUE", "JWT_SECRET", "OUTBOUND_CLIENT_KEY", "API_TEST_REGION"}},
+		{"redaction disabled", nil, []string{"REQUIRED_HEADER_VALUE", "JWT_SECRET", "OUTBOUND_CLIENT_KEY"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redactPatterns = tt.patterns
+			environmentVariables = nil
+			expected := make(map[string]string)
+			for name, value := range env {
+				expected[name] = value
+			}
+			for _, name := range tt.masked {
+				expected[name] = "***"
+			}
+			variables := getEnvironmentVariables()
+			for name, value := range expected {
+				if variables[name] != value {
+					t.Errorf("%v is %q, expected %q", name, variables[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestReadServiceLabelsMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		failed   bool
+	}{
+		{"missing file", filepath.Join(dir, "labels"), false},
+		{"missing directory", filepath.Join(dir, "podinfo", "labels"), false},
+		{"empty file", emptyFile, false},
+		// Other errors than a missing file are still reported
+		{"directory instead of file", dir, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels, err := readServiceLabels(tt.filename)
+			if (err != nil) != tt.failed {
+				t.Errorf("got error %v, expected an error: %v", err, tt.failed)
+			}
+			if labels == nil || len(labels) != 0 {
+				t.Errorf("got labels %v, expected an empty map", labels)
+			}
+		})
+	}
+}
+
+func TestSortedValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string][]string
+		expected map[string][]string
+	}{
+		{"nil", nil, map[string][]string{}},
+		{"single values", map[string][]string{"a": {"1"}, "b": {"2"}}, map[string][]string{"a": {"1"}, "b": {"2"}}},
+		{"unsorted values", map[string][]string{"Accept": {"text/html", "application/json", "*/*"}}, map[string][]string{"Accept": {"*/*", "application/json", "text/html"}}},
+		{"duplicate values", map[string][]string{"x": {"b", "a", "b"}}, map[string][]string{"x": {"a", "b", "b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var original map[string][]string
+			if tt.values != nil {
+				original = make(map[string][]string)
+				for key, values := range tt.values {
+					original[key] = append([]string(nil), values...)
+				}
+			}
+			if sorted := sortedValues(tt.values); !reflect.DeepEqual(sorted, tt.expected) {
+				t.Errorf("sortedValues(%v) = %v, expected %v", tt.values, sorted, tt.expected)
+			}
+			if !reflect.DeepEqual(tt.values, original) {
+				t.Errorf("sortedValues modified its input to %v", tt.values)
+			}
+		})
+	}
+}
+
+func TestGetRequestInfoStableOutput(t *testing.T) {
+	defer func(stable bool) { stableOutput = stable }(stableOutput)
+
+	// The same params, headers and form, sent in a different order
+	newRequest := func(query string, accept []string, form string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/?"+query, strings.NewReader(form))
+		r.Header["Accept"] = accept
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	first := newRequest("tag=b&tag=a", []string{"text/html", "application/json"}, "color=red&color=blue")
+	second := newRequest("tag=a&tag=b", []string{"application/json", "text/html"}, "color=blue&color=red")
+
+	for _, stable := range []bool{true, false} {
+		stableOutput = stable
+		firstInfo, secondInfo := getRequestInfo(first), getRequestInfo(second)
+		for _, field := range []string{"params", "headers", "form"} {
+			if equal := reflect.DeepEqual(firstInfo[field], secondInfo[field]); equal != stable {
+				t.Errorf("stable output %v: %v %v and %v, expected them to be equal: %v", stable, field, firstInfo[field], secondInfo[field], stable)
+			}
+		}
+	}
+}
+
+func TestGetRequestInfoForm(t *testing.T) {
+	defer func(limit int64) { formMaxBytes = limit }(formMaxBytes)
+	formMaxBytes = 32
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		form        map[string][]string
+		formError   bool
+	}{
+		{"urlencoded form", "application/x-www-form-urlencoded", "name=gopher&tag=a&tag=b", map[string][]string{"name": {"gopher"}, "tag": {"a", "b"}}, false},
+		{"urlencoded form with charset", "application/x-www-form-urlencoded; charset=utf-8", "name=caf%C3%A9", map[string][]string{"name": {"café"}}, false},
+		{"json body", "application/json", `{"name": "gopher"}`, nil, false},
+		{"form too large", "application/x-www-form-urlencoded", "name=" + strings.Repeat("x", 40), nil, true},
+		{"malformed form", "application/x-www-form-urlencoded", "name=%zz", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			info := getRequestInfo(r)
+
+			form, _ := info["form"].(map[string][]string)
+			if !reflect.DeepEqual(form, tt.form) {
+				t.Errorf("form %v, expected %v", info["form"], tt.form)
+			}
+			if _, failed := info["formError"]; failed != tt.formError {
+				t.Errorf("formError %v, expected an error: %v", info["formError"], tt.formError)
+			}
+			// The body is left for the handler to read
+			if body, err := ioutil.ReadAll(r.Body); err != nil || string(body) != tt.body {
+				t.Errorf("body after parsing the form is %q (%v), expected %q", body, err, tt.body)
+			}
+		})
+	}
+}
+
+func TestCallParamRules(t *testing.T) {
+	defer func(timeout time.Duration) { requestTimeoutDuration = timeout }(requestTimeoutDuration)
+	requestTimeoutDuration = 10 * time.Second
+
+	tests := []struct {
+		query string
+		// err is the error of the 400 response, empty if the params are valid
+		err string
+	}{
+		{"url=http://example.com/", ""},
+		{"url=https://example.com/&method=head&timeout=2s", ""},
+		{"url=http://example.com/&method=DELETE&timeout=10s", ""},
+		{"", "ERROR: missing url param"},
+		{"method=GET", "ERROR: missing url param"},
+		{"url=ftp://example.com/", `ERROR: invalid url param: invalid url "ftp://example.com/": scheme must be http or https`},
+		{"url=http://", `ERROR: invalid url param: invalid url "http://": missing host`},
+		{"url=http://example.com/&method=POST", `ERROR: invalid method param: "POST" is not one of GET, HEAD, DELETE or OPTIONS`},
+		{"url=http://example.com/&timeout=soon", `ERROR: invalid timeout param: "soon" is not a duration up to 10s`},
+		{"url=http://example.com/&timeout=-1s", `ERROR: invalid timeout param: "-1s" is not a duration up to 10s`},
+		{"url=http://example.com/&timeout=11s", `ERROR: invalid timeout param: "11s" is not a duration up to 10s`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			called := false
+			h := requireValidParams(callParamRules...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/call/?"+tt.query, nil))
+
+			if tt.err == "" {
+				if !called || w.Code != http.StatusOK {
+					t.Errorf("valid params were rejected with %v: %v", w.Code, w.Body)
+				}
+				return
+			}
+			var response map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid json response %q: %v", w.Body, err)
+			}
+			if called || w.Code != http.StatusBadRequest || response["error"] != tt.err {
+				t.Errorf("got %v with error %v (handler called: %v), expected a 400 with error %v", w.Code, response["error"], called, tt.err)
+			}
+		})
+	}
+}
+
+func TestDuplicateURLParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		count float64
+	}{
+		{"two urls", "url=http://a.example/&url=http://b.example/", 2},
+		{"three urls", "url=http://a.example/&url=http://b.example/&url=http://c.example/", 3},
+		{"same url twice", "url=http://a.example/&url=http://a.example/", 2},
+	}
+	router := getRouter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/call/?"+tt.query, nil))
+			var response map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &response)
+			expectedError := fmt.Sprintf("ERROR: expected a single url param, got %v", tt.count)
+			if w.Code != http.StatusBadRequest || response["error"] != expectedError {
+				t.Errorf("status %v and error %v, expected a 400 with %v", w.Code, response["error"], expectedError)
+			}
+			if response["param"] != "url" || response["count"] != tt.count {
+				t.Errorf("param %v and count %v, expected url and %v", response["param"], response["count"], tt.count)
+			}
+		})
+	}
+}
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		status int
+		err    string
+	}{
+		{http.MethodGet, "/does-not-exist", http.StatusNotFound, "ERROR: Not found: no route for path /does-not-exist"},
+		{http.MethodPost, "/status/200/extra", http.StatusNotFound, "ERROR: Not found: no route for path /status/200/extra"},
+		{http.MethodGet, "/request", http.StatusMethodNotAllowed, "ERROR: Method GET not allowed for path /request"},
+		{http.MethodPut, "/mock", http.StatusMethodNotAllowed, "ERROR: Method PUT not allowed for path /mock"},
+	}
+	router := getRouter()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			requests := getRequestCount()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid json response %q: %v", w.Body, err)
+			}
+			if w.Code != tt.status || response["error"] != tt.err {
+				t.Errorf("got %v with error %v, expected %v with %v", w.Code, response["error"], tt.status, tt.err)
+			}
+			if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+				t.Errorf("Content-Type %q, expected json", contentType)
+			}
+			// Like matched requests, they go through the request logging
+			if w.Header().Get("X-Response-Time-Ms") == "" || getRequestCount() != requests+1 {
+				t.Errorf("the request wasn't handled by logHTTPRequest")
+			}
+		})
+	}
+}
+
+func TestReadServiceLabelsFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(format string) { labelsFormat = format }(labelsFormat)
+
+	tests := []struct {
+		name     string
+		format   string
+		contents string
+		expected map[string]string
+		failed   bool
+	}{
+		{"key value", "keyvalue", "app=\"web\"\ntier=\"frontend\"\n", map[string]string{"app": "web", "tier": "frontend"}, false},
+		{"key value with = in value", "keyvalue", "query=\"a=b=c\"\n", map[string]string{"query": "a=b=c"}, false},
+		{"key value skips lines without =", "keyvalue", "app=\"web\"\nnot a label\n\n", map[string]string{"app": "web"}, false},
+		{"flat json", "json", `{"app": "web", "tier": "frontend"}`, map[string]string{"app": "web", "tier": "frontend"}, false},
+		{"nested json", "json", `{"app": {"name": "web", "tier": {"level": "frontend"}}, "zone": "b"}`,
+			map[string]string{"app.name": "web", "app.tier.level": "frontend", "zone": "b"}, false},
+		{"json arrays and other values", "json", `{"ports": [80, 443], "canary": true, "owner": null, "tags": [{"k": "v"}]}`,
+			map[string]string{"ports.0": "80", "ports.1": "443", "canary": "true", "owner": "null", "tags.0.k": "v"}, false},
+		{"invalid json", "json", `{"app": `, map[string]string{}, true},
+		{"auto detects json", "auto", "\n  {\"app\": {\"name\": \"web\"}}", map[string]string{"app.name": "web"}, false},
+		{"auto detects key value", "auto", "app=\"web\"", map[string]string{"app": "web"}, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, strconv.Itoa(i))
+			if err := ioutil.WriteFile(filename, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			labelsFormat = tt.format
+			labels, err := readServiceLabels(filename)
+			if (err != nil) != tt.failed {
+				t.Errorf("got error %v, expected an error: %v", err, tt.failed)
+			}
+			if !reflect.DeepEqual(labels, tt.expected) {
+				t.Errorf("labels %v, expected %v", labels, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected bool
+	}{
+		{"", true},
+		{"*/*", true},
+		{"application/json", true},
+		{"application/*", true},
+		{"text/html, application/json;q=0.5", true},
+		{"APPLICATION/JSON", true},
+		{"text/html", false},
+		{"text/*", false},
+		{"application/json;q=0", false},
+		{"application/json;q=0, */*;q=0", false},
+	}
+	for _, tt := range tests {
+		if accepted := accepts(tt.accept, []string{"application/json"}); accepted != tt.expected {
+			t.Errorf("accepts(%q) = %v, expected %v", tt.accept, accepted, tt.expected)
+		}
+	}
+}
+
+func TestStrictNegotiation(t *testing.T) {
+	defer func(strict bool) { strictNegotiation = strict }(strictNegotiation)
+
+	s := newService("test")
+	tests := []struct {
+		name   string
+		strict bool
+		accept string
+		status int
+	}{
+		{"lenient html client gets json", false, "text/html", http.StatusOK},
+		{"lenient refused json still gets json", false, "application/json;q=0", http.StatusOK},
+		{"strict json client", true, "application/json", http.StatusOK},
+		{"strict wildcard", true, "text/html, */*;q=0.1", http.StatusOK},
+		{"strict html client", true, "text/html", http.StatusNotAcceptable},
+		{"strict refused json", true, "application/json;q=0", http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strictNegotiation = tt.strict
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			s.indexHandler().ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %v, expected %v", w.Code, tt.status)
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("content type %q, expected application/json", w.Header().Get("Content-Type"))
+			}
+			var response map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid json response: %v", err)
+			}
+			if tt.status == http.StatusNotAcceptable {
+				if !reflect.DeepEqual(response["producible"], []interface{}{"application/json"}) {
+					t.Errorf("producible %v, expected [application/json]", response["producible"])
+				}
+			} else if _, found := response["service"]; !found {
+				t.Errorf("response %v has no service info", response)
+			}
+		})
+	}
+}
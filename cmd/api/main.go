@@ -4,33 +4,77 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/stackdriver"
-	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 )
 
 var (
-	listenAddr             string
-	livenessListenAddr     string
-	logLevel               = flag.Int("log", 0, "-1=debug+, 0=info+, 1=warn+, 2=error+")
-	serviceName            = ""
-	logger                 *zap.SugaredLogger
-	environmentName        = "local"
-	requestTimeoutDuration = 60 * time.Second
+	listenAddr              string
+	livenessListenAddr      string
+	livenessShutdownTimeout = 5 * time.Second
+	livenessShutdownDelay   time.Duration
+	traceFlushTimeout       = 5 * time.Second
+	traceSampleRate         = 0.0
+	adaptiveSampling        = false
+	traceLatencyThreshold   = 1 * time.Second
+	traceErrorStatus        = http.StatusInternalServerError
+	logLevel                = flag.Int("log", 0, "-1=debug+, 0=info+, 1=warn+, 2=error+")
+	serviceName             = ""
+	logger                  = newFallbackLogger()
+	atomicLogLevel          = zap.NewAtomicLevel()
+	environmentName         = "local"
+	pathPrefix              = ""
+	healthPath              = "/_ah/health/"
+	readyPath               = "/_ah/ready/"
+	readinessDependencies   []dependency
+	warmupDuration          time.Duration
+	healthWritePath         string
+	heartbeatInterval       time.Duration
+	jwtKeyfunc              jwt.Keyfunc
+	requiredHeaderName      = "X-Internal-Token"
+	requiredHeaderValue     = ""
+	staticDir               = ""
+	responseHeaders         map[string]string
+	staticListing           = false
+	recentBufferSize        = 100
+	maxHeaderBytes          = http.DefaultMaxHeaderBytes
+	tracePropagation        = "gcp"
+	urlValidation           = "utf8"
+	allowedHosts            []string
+	enabledRoutes           []string
+	stableOutput                  = false
+	strictNegotiation             = false
+	coalesceCalls                 = true
+	redirectToHTTPS               = false
+	rootMode                      = "json"
+	redactPatterns                = []string{"SECRET", "TOKEN", "PASSWORD", "KEY"}
+	strictSlash                   = false
+	serverTimeouts                = timeouts{read: 5 * time.Second, readHeader: 2 * time.Second, write: 10 * time.Second, idle: 15 * time.Second}
+	livenessTimeouts              = timeouts{read: 5 * time.Second, readHeader: 2 * time.Second, write: 5 * time.Second, idle: 5 * time.Second}
+	logPanicStacks                = true
+	decompressMaxBytes      int64 = 10 << 20
+	drainMode                     = "fixed"
+	drainDelay                    = 10 * time.Second
+	drainQuietPeriod              = 2 * time.Second
+	requestTimeoutDuration        = 60 * time.Second
 )
 
 // IsDevelopment returns if we are running in development mode
@@ -42,32 +86,300 @@ func IsDevelopment() bool {
 	return false
 }
 
-// startLivenessServer fires up a server on the specified listen address which exclusively answers health checks
-func startLivenessServer(address string) *http.Server {
+// getEnvInt returns the integer value of an environment variable, or the fallback if it is unset or invalid
+func getEnvInt(name string, fallback int) int {
+	if envVar := os.Getenv(name); envVar != "" {
+		if value, err := strconv.Atoi(envVar); err == nil {
+			return value
+		}
+		logger.Warnf("invalid integer value %q for %v, using default %v", envVar, name, fallback)
+	}
+	return fallback
+}
+
+// getEnvDuration returns the duration value of an environment variable (e.g. "1m30s"),
+// or the fallback if it is unset or invalid
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	if envVar := os.Getenv(name); envVar != "" {
+		if value, err := time.ParseDuration(envVar); err == nil {
+			return value
+		}
+		logger.Warnf("invalid duration value %q for %v, using default %v", envVar, name, fallback)
+	}
+	return fallback
+}
+
+// readEnvironmentConfig overrides the default settings with the ones given in environment variables
+func readEnvironmentConfig() {
+	circuitBreakerThreshold = getEnvInt("CIRCUIT_BREAKER_THRESHOLD", circuitBreakerThreshold)
+	circuitBreakerCooldown = getEnvDuration("CIRCUIT_BREAKER_COOLDOWN", circuitBreakerCooldown)
+	circuitBreakersMaxHosts = getEnvInt("CIRCUIT_BREAKER_MAX_HOSTS", circuitBreakersMaxHosts)
+	retryAfterMaxRetries = getEnvInt("RETRY_AFTER_MAX_RETRIES", retryAfterMaxRetries)
+	retryAfterMaxWait = getEnvDuration("RETRY_AFTER_MAX_WAIT", retryAfterMaxWait)
+	if err := configureOutboundTLS(os.Getenv("OUTBOUND_CLIENT_CERT"), os.Getenv("OUTBOUND_CLIENT_KEY"), os.Getenv("OUTBOUND_CA_BUNDLE")); err != nil {
+		logger.Fatalf("invalid outbound TLS configuration: %v", err)
+	}
+	if getEnvInt("OUTBOUND_INSECURE_SKIP_VERIFY", 0) == 1 {
+		// Only affects outgoing requests made with DefaultHTTPClient, the server itself is not affected
+		outboundTLSConfig().InsecureSkipVerify = true
+		logger.Warnf("WARNING: TLS certificate verification is DISABLED for outbound calls (OUTBOUND_INSECURE_SKIP_VERIFY=1), do not use this in production")
+	}
+	// Connection pool of the outbound client: fanning out to many distinct hosts needs more idle connections overall,
+	// heavy use of a single host more per host
+	defaultTransport.MaxIdleConns = getEnvInt("OUTBOUND_MAX_IDLE_CONNS", defaultTransport.MaxIdleConns)
+	defaultTransport.MaxIdleConnsPerHost = getEnvInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", defaultTransport.MaxIdleConnsPerHost)
+	defaultTransport.MaxConnsPerHost = getEnvInt("OUTBOUND_MAX_CONNS_PER_HOST", defaultTransport.MaxConnsPerHost)
+	logger.Infof("outbound connection pool: max idle connections %v, max idle connections per host %v, max connections per host %v (0 is unlimited)",
+		defaultTransport.MaxIdleConns, defaultTransport.MaxIdleConnsPerHost, defaultTransport.MaxConnsPerHost)
+	if proxy := proxyEnvironment(); len(proxy) > 0 {
+		logger.Infof("outbound calls use the proxy settings %v", proxy)
+	} else {
+		logger.Infof("outbound calls don't use a proxy")
+	}
+	outboundWorkers.resize(getEnvInt("OUTBOUND_WORKERS", outboundWorkers.size()))
+	outboundWorkers.queueTimeout = getEnvDuration("OUTBOUND_QUEUE_TIMEOUT", outboundWorkers.queueTimeout)
+	logger.Infof("outbound worker pool: %v workers (0 is unlimited), queue timeout %v", outboundWorkers.size(), outboundWorkers.queueTimeout)
+	pathPrefix = os.Getenv("PATH_PREFIX")
+	if path := os.Getenv("HEALTH_PATH"); path != "" {
+		healthPath = path
+	}
+	if path := os.Getenv("READY_PATH"); path != "" {
+		readyPath = path
+	}
+	staticDir = os.Getenv("STATIC_DIR")
+	staticListing = getEnvInt("STATIC_LISTING", 0) == 1
+	recentBufferSize = getEnvInt("RECENT_BUFFER_SIZE", recentBufferSize)
+	maxHeaderBytes = getEnvInt("MAX_HEADER_BYTES", maxHeaderBytes)
+	if format := os.Getenv("TRACE_PROPAGATION"); format != "" {
+		if format != "gcp" && format != "w3c" {
+			logger.Fatalf("invalid TRACE_PROPAGATION %q, expected gcp or w3c", format)
+		}
+		tracePropagation = format
+	}
+	tracingTransport.Propagation = newPropagationFormat(tracePropagation)
+	if mode := os.Getenv("URL_VALIDATION"); mode != "" {
+		if mode != "off" && mode != "utf8" && mode != "strict" {
+			logger.Fatalf("invalid URL_VALIDATION %q, expected off, utf8 or strict", mode)
+		}
+		urlValidation = mode
+	}
+	headers, err := parseDefaultHeaders(os.Getenv("DEFAULT_HEADERS"))
+	if err != nil {
+		logger.Fatalf("invalid DEFAULT_HEADERS: %v", err)
+	}
+	responseHeaders = headers
+	for _, host := range strings.Split(os.Getenv("ALLOWED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+	for _, route := range strings.Split(os.Getenv("ENABLED_ROUTES"), ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			enabledRoutes = append(enabledRoutes, route)
+		}
+	}
+	stableOutput = getEnvInt("STABLE_OUTPUT", 0) == 1
+	strictNegotiation = getEnvInt("STRICT_NEGOTIATION", 0) == 1
+	coalesceCalls = getEnvInt("COALESCE_CALLS", 1) == 1
+	redirectToHTTPS = getEnvInt("REDIRECT_HTTPS", 0) == 1
+	if mode := os.Getenv("ROOT_MODE"); mode != "" {
+		if mode != "json" && mode != "html" {
+			logger.Fatalf("invalid ROOT_MODE %q, expected json or html", mode)
+		}
+		rootMode = mode
+	}
+	if patterns, ok := os.LookupEnv("REDACT_PATTERNS"); ok {
+		redactPatterns = nil
+		for _, pattern := range strings.Split(patterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				redactPatterns = append(redactPatterns, pattern)
+			}
+		}
+	}
+	strictSlash = getEnvInt("STRICT_SLASH", 0) == 1
+	serverTimeouts = readTimeoutsConfig("SERVER", serverTimeouts)
+	livenessTimeouts = readTimeoutsConfig("LIVENESS", livenessTimeouts)
+	logPanicStacks = getEnvInt("LOG_PANIC_STACKS", 1) == 1
+	decompressMaxBytes = int64(getEnvInt("DECOMPRESS_MAX_BYTES", int(decompressMaxBytes)))
+	if mode := os.Getenv("DRAIN_MODE"); mode != "" {
+		if mode != "fixed" && mode != "quiet" {
+			logger.Fatalf("invalid DRAIN_MODE %q, expected fixed or quiet", mode)
+		}
+		drainMode = mode
+	}
+	drainDelay = getEnvDuration("DRAIN_DELAY", drainDelay)
+	drainQuietPeriod = getEnvDuration("DRAIN_QUIET_PERIOD", drainQuietPeriod)
+	livenessShutdownTimeout = getEnvDuration("LIVENESS_SHUTDOWN_TIMEOUT", livenessShutdownTimeout)
+	livenessShutdownDelay = getEnvDuration("LIVENESS_SHUTDOWN_DELAY", livenessShutdownDelay)
+	traceFlushTimeout = getEnvDuration("TRACE_FLUSH_TIMEOUT", traceFlushTimeout)
+	if rate := os.Getenv("TRACE_SAMPLE_RATE"); rate != "" {
+		value, err := strconv.ParseFloat(rate, 64)
+		if err != nil || value < 0 || value > 1 {
+			logger.Fatalf("invalid TRACE_SAMPLE_RATE %q, expected a number between 0 and 1", rate)
+		}
+		traceSampleRate = value
+	}
+	adaptiveSampling = getEnvInt("TRACE_ADAPTIVE_SAMPLING", 0) == 1
+	traceLatencyThreshold = getEnvDuration("TRACE_LATENCY_THRESHOLD", traceLatencyThreshold)
+	traceErrorStatus = getEnvInt("TRACE_ERROR_STATUS", traceErrorStatus)
+
+	dependencies, err := parseDependencies(os.Getenv("DEPENDENCIES"), getEnvDuration("DEPENDENCY_TIMEOUT", 2*time.Second))
+	if err != nil {
+		logger.Fatalf("invalid DEPENDENCIES: %v", err)
+	}
+	readinessDependencies = dependencies
+	healthWritePath = os.Getenv("HEALTH_WRITE_PATH")
+	warmupDuration = getEnvDuration("WARMUP_DURATION", warmupDuration)
+	heartbeatInterval = getEnvDuration("HEARTBEAT_INTERVAL", heartbeatInterval)
+
+	keyfunc, err := newJWTKeyfunc(os.Getenv("JWT_SECRET"), os.Getenv("JWT_PUBLIC_KEY"))
+	if err != nil {
+		logger.Fatalf("invalid JWT configuration: %v", err)
+	}
+	jwtKeyfunc = keyfunc
+	if name := os.Getenv("REQUIRED_HEADER_NAME"); name != "" {
+		requiredHeaderName = name
+	}
+	requiredHeaderValue = os.Getenv("REQUIRED_HEADER_VALUE")
+	labelsRetryInterval = getEnvDuration("LABELS_RETRY_INTERVAL", labelsRetryInterval)
+	if format := os.Getenv("LABELS_FORMAT"); format != "" {
+		if format != "auto" && format != "keyvalue" && format != "json" {
+			logger.Fatalf("invalid LABELS_FORMAT %q, expected auto, keyvalue or json", format)
+		}
+		labelsFormat = format
+	}
+	maxDelay = getEnvDuration("MAX_DELAY", maxDelay)
+	maxBytes = int64(getEnvInt("MAX_BYTES", int(maxBytes)))
+	rawMaxBodyBytes = int64(getEnvInt("RAW_MAX_BODY_BYTES", int(rawMaxBodyBytes)))
+	requestSpecMaxBytes = int64(getEnvInt("REQUEST_SPEC_MAX_BYTES", int(requestSpecMaxBytes)))
+	wsMaxMessageBytes = int64(getEnvInt("WS_MAX_MESSAGE_BYTES", int(wsMaxMessageBytes)))
+	wsReadTimeout = getEnvDuration("WS_READ_TIMEOUT", wsReadTimeout)
+	wsWriteTimeout = getEnvDuration("WS_WRITE_TIMEOUT", wsWriteTimeout)
+	wsShutdownGracePeriod = getEnvDuration("WS_SHUTDOWN_GRACE_PERIOD", wsShutdownGracePeriod)
+	dnsLookupTimeout = getEnvDuration("DNS_LOOKUP_TIMEOUT", dnsLookupTimeout)
+	formMaxBytes = int64(getEnvInt("FORM_MAX_BYTES", int(formMaxBytes)))
+	maxResponseBytes = int64(getEnvInt("MAX_RESPONSE_BYTES", int(maxResponseBytes)))
+	allowDebug = getEnvInt("ALLOW_DEBUG", 0) == 1
+	debugMaxBodyBytes = getEnvInt("DEBUG_MAX_BODY_BYTES", debugMaxBodyBytes)
+	if headers := os.Getenv("DEBUG_REDACT_HEADERS"); headers != "" {
+		debugRedactedHeaders = strings.Split(headers, ",")
+	}
+}
+
+// redacted masks a secret for logging, only showing whether it is set
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
+
+// logEffectiveConfig logs the configuration after applying the flags and env variables in a single line,
+// so misconfigurations are obvious from the first log lines. Secrets are redacted.
+func logEffectiveConfig() {
+	dependencies := make([]string, 0, len(readinessDependencies))
+	for _, d := range readinessDependencies {
+		dependencies = append(dependencies, d.name)
+	}
+	logger.Infow("effective configuration",
+		"listenAddresses", parseListenAddresses(listenAddr),
+		"livenessListenAddress", livenessListenAddr,
+		"livenessDisabled", isLivenessServerDisabled(),
+		"development", IsDevelopment(),
+		"environment", environmentName,
+		"logLevel", atomicLogLevel.Level().String(),
+		"pathPrefix", pathPrefix,
+		"healthPath", healthPath,
+		"readyPath", readyPath,
+		"rootMode", rootMode,
+		"strictNegotiation", strictNegotiation,
+		"labelsFormat", labelsFormat,
+		"enabledRoutes", enabledRoutes,
+		"strictSlash", strictSlash,
+		"serverTimeouts", fmt.Sprintf("read=%v readHeader=%v write=%v idle=%v", serverTimeouts.read, serverTimeouts.readHeader, serverTimeouts.write, serverTimeouts.idle),
+		"livenessTimeouts", fmt.Sprintf("read=%v readHeader=%v write=%v idle=%v", livenessTimeouts.read, livenessTimeouts.readHeader, livenessTimeouts.write, livenessTimeouts.idle),
+		"requestTimeout", requestTimeoutDuration.String(),
+		"drain", fmt.Sprintf("mode=%v delay=%v quietPeriod=%v livenessShutdownDelay=%v", drainMode, drainDelay, drainQuietPeriod, livenessShutdownDelay),
+		"warmupDuration", warmupDuration.String(),
+		"heartbeatInterval", heartbeatInterval.String(),
+		"dependencies", dependencies,
+		"healthWritePath", healthWritePath,
+		"tracing", fmt.Sprintf("project=%v sampleRate=%v adaptive=%v latencyThreshold=%v errorStatus=%v", os.Getenv("GCP_PROJECT"), traceSampleRate, adaptiveSampling, traceLatencyThreshold, traceErrorStatus),
+		"requiredHeader", requiredHeaderName,
+		"requiredHeaderValue", redacted(requiredHeaderValue),
+		"jwtAuth", jwtKeyfunc != nil,
+		"allowedHosts", allowedHosts,
+		"defaultHeaders", responseHeaders,
+		"redirectHTTPS", redirectToHTTPS,
+		"redactPatterns", redactPatterns,
+		"circuitBreaker", fmt.Sprintf("threshold=%v cooldown=%v maxHosts=%v", circuitBreakerThreshold, circuitBreakerCooldown, circuitBreakersMaxHosts),
+		"coalesceCalls", coalesceCalls,
+		"outboundWorkers", fmt.Sprintf("size=%v queueTimeout=%v", outboundWorkers.size(), outboundWorkers.queueTimeout),
+		"allowDebug", allowDebug,
+		"staticDir", staticDir,
+		"maxHeaderBytes", maxHeaderBytes,
+	)
+}
+
+// isLivenessServerDisabled returns if the separate liveness server should not be started,
+// which is the case if its listen address is empty or the DISABLE_LIVENESS env variable is set to 1
+func isLivenessServerDisabled() bool {
+	return livenessListenAddr == "" || getEnvInt("DISABLE_LIVENESS", 0) == 1
+}
+
+// timeouts holds the timeouts of a http.Server. The read header timeout protects against slowloris attacks,
+// in which clients keep connections busy by sending the request headers very slowly.
+type timeouts struct {
+	read       time.Duration
+	readHeader time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// readTimeoutsConfig overrides the given timeouts with the env variables starting with the prefix, if set
+func readTimeoutsConfig(prefix string, t timeouts) timeouts {
+	return timeouts{
+		read:       getEnvDuration(prefix+"_READ_TIMEOUT", t.read),
+		readHeader: getEnvDuration(prefix+"_READ_HEADER_TIMEOUT", t.readHeader),
+		write:      getEnvDuration(prefix+"_WRITE_TIMEOUT", t.write),
+		idle:       getEnvDuration(prefix+"_IDLE_TIMEOUT", t.idle),
+	}
+}
+
+// startLivenessServer fires up a server on the specified listen address which exclusively answers health checks.
+// The address is bound synchronously, so an error is returned right away if it is unavailable.
+func startLivenessServer(address string) (*http.Server, error) {
 	r := mux.NewRouter()
-	r.HandleFunc("/_ah/health/", (&healthService{}).healthCheck())
+	r.HandleFunc(healthPath, (&healthService{}).healthCheck())
 
 	srv := http.Server{
-		Addr:         address,
-		Handler:      r,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		IdleTimeout:  5 * time.Second,
+		Addr:              address,
+		Handler:           r,
+		ReadTimeout:       livenessTimeouts.read,
+		ReadHeaderTimeout: livenessTimeouts.readHeader,
+		WriteTimeout:      livenessTimeouts.write,
+		IdleTimeout:       livenessTimeouts.idle,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
 	}
 
 	go func() {
 		logger.Debugf("liveness server listening on %v", address)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			logger.Fatalf("failed to start liveness server: %v", err)
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			logger.Fatalf("liveness server failed: %v", err)
 		}
 	}()
 
-	return &srv
+	return &srv, nil
 }
 
 func shutdownLivenessServer(srv *http.Server) {
 	logger.Debugf("liveness server shutting down...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), livenessShutdownTimeout)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
@@ -79,63 +391,206 @@ func shutdownLivenessServer(srv *http.Server) {
 
 /************************** Main server **************************/
 
+// isRouteEnabled returns whether the route with the given path is in ENABLED_ROUTES, which enables all routes if empty
+func isRouteEnabled(path string) bool {
+	if len(enabledRoutes) == 0 {
+		return true
+	}
+	for _, route := range enabledRoutes {
+		if route == path {
+			return true
+		}
+	}
+	return false
+}
+
 // getRouter creates a router (which is a handler) for the server to use in serving traffic.
 // It links paths to services, handlers and middleware.
 func getRouter() *mux.Router {
-	healthServerHandlers := &healthService{}
+	healthServerHandlers := &healthService{dependencies: readinessDependencies, writePath: healthWritePath}
 	mainServerHandlers := newService("Inspector")
 
-	router := mux.NewRouter()
-	router.Handle("/_ah/health/", adapt(healthServerHandlers.healthCheck(), addRequestTimeout(), logHTTPRequest()))
-	router.Handle("/_ah/ready/", adapt(healthServerHandlers.healthCheck(), addRequestTimeout(), logHTTPRequest()))
-	router.Handle("/call/", adapt(mainServerHandlers.callHandler(), addRequestTimeout(), logHTTPRequest()))
-	router.Handle("/", adapt(mainServerHandlers.indexHandler(), addRequestTimeout(), logHTTPRequest()))
+	recentRequests := newRequestRing(recentBufferSize)
+
+	// Middleware chains, applied from the outermost to the innermost middleware
+	healthChain := chain(addRequestLogger(), defaultHeaders(responseHeaders), logHTTPRequest(), recoverPanics(logPanicStacks), instrumentRequest(), addSpanAttributes(), addRequestTimeout(), handleHeadRequests())
+	mainChain := chain(addRequestLogger(), defaultHeaders(responseHeaders), trackInFlightRequests(inFlightRequests), addTraceIDHeader(), addServerTiming(), logHTTPRequest(), recoverPanics(logPanicStacks), validateHost(allowedHosts), redirectHTTPS(redirectToHTTPS), instrumentRequest(), recordRecentRequests(recentRequests), addSpanAttributes(), addRequestTimeout(), rejectDuringMaintenance(), requireHeader(requiredHeaderName, requiredHeaderValue), jwtAuth(jwtKeyfunc, ""), decompressRequest(decompressMaxBytes), handleHeadRequests())
+	metricsChain := chain(addRequestLogger(), defaultHeaders(responseHeaders), logHTTPRequest(), recoverPanics(logPanicStacks), addRequestTimeout(), handleHeadRequests())
+	// The WebSocket connection outlives the request, so it bypasses the request timeout and access logging middleware.
+	// Browsers can't set the Authorization header when opening a WebSocket, so the token can be passed as query param.
+	wsChain := chain(addRequestLogger(), defaultHeaders(responseHeaders), recoverPanics(logPanicStacks), validateHost(allowedHosts), requireHeader(requiredHeaderName, requiredHeaderValue), jwtAuth(jwtKeyfunc, "access_token"))
+	// Requests which don't match a route are still logged and counted, like the other ones
+	errorChain := chain(addRequestLogger(), defaultHeaders(responseHeaders), addTraceIDHeader(), logHTTPRequest(), recoverPanics(logPanicStacks), instrumentRequest())
+
+	// With strict slash, a path without the trailing slash of a route (e.g. /call) is redirected to it (/call/) with a 301
+	router := mux.NewRouter().StrictSlash(strictSlash)
+	router.NotFoundHandler = errorChain(notFoundHandler())
+	router.MethodNotAllowedHandler = errorChain(methodNotAllowedHandler())
+	router.Handle(healthPath, healthChain(healthServerHandlers.healthCheck()))
+	router.Handle(readyPath, healthChain(healthServerHandlers.readinessCheck()))
+	// Routes which aren't enabled are registered on a separate router which never serves, so they're 404s
+	disabledRouter := mux.NewRouter()
+	handle := func(path string, handler http.Handler) *mux.Route {
+		if !isRouteEnabled(path) {
+			return disabledRouter.Handle(path, handler)
+		}
+		return router.Handle(path, handler)
+	}
+	handle("/headers", mainChain(mainServerHandlers.headersHandler()))
+	handle("/tls", mainChain(mainServerHandlers.tlsHandler()))
+	handle("/call/", mainChain(requireValidParams(callParamRules...)(mainServerHandlers.callHandler())))
+	handle("/request", mainChain(mainServerHandlers.requestHandler())).Methods(http.MethodPost)
+	handle("/status/{code}", mainChain(mainServerHandlers.statusHandler()))
+	handle("/mock", mainChain(mainServerHandlers.mockHandler())).Methods(http.MethodGet, http.MethodPost, http.MethodHead)
+	handle("/bytes/{n}", mainChain(mainServerHandlers.bytesHandler()))
+	handle("/drip", mainChain(requireValidParams(dripParamRules...)(mainServerHandlers.dripHandler())))
+	handle("/raw", mainChain(mainServerHandlers.rawHandler()))
+	handle("/dns", mainChain(mainServerHandlers.dnsHandler()))
+	handle("/fds", mainChain(mainServerHandlers.fdsHandler()))
+	handle("/deps", mainChain(mainServerHandlers.depsHandler()))
+	handle("/metrics", metricsChain(metricsHandler()))
+	handle("/recent", mainChain(mainServerHandlers.recentHandler(recentRequests)))
+	handle("/routes", mainChain(mainServerHandlers.routesHandler(router)))
+	handle("/match", mainChain(requireValidParams(matchParamRules...)(mainServerHandlers.matchHandler(router))))
+	if staticDir != "" && isRouteEnabled("/static/") {
+		router.PathPrefix("/static/").Handler(mainChain(http.StripPrefix("/static/", staticHandler(staticDir, staticListing))))
+	}
+	// The admin endpoints change the server's behaviour, so they're only available when protected by the shared secret
+	if requiredHeaderValue != "" {
+		handle("/admin/loglevel", mainChain(mainServerHandlers.logLevelHandler())).Methods(http.MethodPost)
+	}
+	handle("/ws", wsChain(mainServerHandlers.wsEchoHandler()))
+	handle("/info", mainChain(mainServerHandlers.indexHandler()))
+	if rootMode == "html" {
+		handle("/", mainChain(mainServerHandlers.landingPageHandler(router)))
+	} else {
+		handle("/", mainChain(mainServerHandlers.indexHandler()))
+	}
 
 	return router
 }
 
+// getLogOutputPaths returns the paths the logger writes to, given as a comma-separated list of zap sink paths
+// (e.g. "stdout,/var/log/api.log") in the LOG_OUTPUT env variable. Defaults to stdout.
+func getLogOutputPaths() []string {
+	outputPaths := []string{}
+	for _, path := range strings.Split(os.Getenv("LOG_OUTPUT"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			outputPaths = append(outputPaths, path)
+		}
+	}
+	if len(outputPaths) == 0 {
+		return []string{"stdout"}
+	}
+	return outputPaths
+}
+
+// newFallbackLogger returns the logger used until setupLogger has run (e.g. when handlers are called without main),
+// which writes to stderr, so early log lines don't hit a nil logger and aren't lost either
+func newFallbackLogger() *zap.SugaredLogger {
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.Lock(os.Stderr), zapcore.InfoLevel)
+	return zap.New(core).Sugar()
+}
+
 // setupLogger configures a logger with the desired log level
 func setupLogger(loggingLevel int) {
+	atomicLogLevel.SetLevel(zapcore.Level(loggingLevel))
 	encoding := "console"
 	encoderConfig := zap.NewDevelopmentEncoderConfig()
 	if !IsDevelopment() {
 		encoding = "json"
 		encoderConfig = zap.NewProductionEncoderConfig()
 	}
-	zapLogger, _ := zap.Config{
-		Level:            zap.NewAtomicLevelAt(zapcore.Level(loggingLevel)),
+	zapLogger, err := zap.Config{
+		Level:            atomicLogLevel,
 		Development:      IsDevelopment(),
 		Encoding:         encoding,
 		EncoderConfig:    encoderConfig,
-		OutputPaths:      []string{"stdout"},
+		OutputPaths:      getLogOutputPaths(),
 		ErrorOutputPaths: []string{"stderr"},
 	}.Build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up logger: %v\n", err)
+		os.Exit(1)
+	}
 	logger = zapLogger.Sugar()
 }
 
+// cycleLogLevelOnSignal lowers the log level by one step (e.g. info -> debug) every time SIGHUP is received,
+// wrapping around from debug to warn, so the verbosity of a running server can be changed without a restart.
+// The change is logged at warn level, so it always shows up.
+func cycleLogLevelOnSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		level := atomicLogLevel.Level() - 1
+		if level < zapcore.DebugLevel || level > zapcore.WarnLevel {
+			level = zapcore.WarnLevel
+		}
+		atomicLogLevel.SetLevel(level)
+		logger.Warnf("received SIGHUP, log level changed to %v", level)
+	}
+}
+
+// parseListenAddresses splits the comma-separated list of listen addresses, ignoring empty entries
+func parseListenAddresses(spec string) []string {
+	var addresses []string
+	for _, address := range strings.Split(spec, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// getEnvironmentName returns the name of the environment given in the ENVIRONMENT env var. The fallback is kept
+// when it's unset or empty, so span names don't end up like "Recv.Inspector.: /"
+func getEnvironmentName(fallback string) string {
+	if environment := os.Getenv("ENVIRONMENT"); environment != "" {
+		return environment
+	}
+	return fallback
+}
+
 func main() {
-	flag.StringVar(&listenAddr, "listen-addr", ":8282", "server listen address")
-	flag.StringVar(&livenessListenAddr, "liveness-listen-addr", ":9000", "liveness check listen address")
+	flag.StringVar(&listenAddr, "listen-addr", ":8282", "comma-separated list of server listen addresses")
+	flag.StringVar(&livenessListenAddr, "liveness-listen-addr", ":9000", "liveness check listen address, empty to disable the liveness server")
 	flag.Parse()
 
-	environmentName = os.Getenv("ENVIRONMENT")
+	environmentName = getEnvironmentName(environmentName)
 
 	setupLogger(*logLevel)
 	defer logger.Sync()
 
-	// Liveness checks handles by separate server to avoid premature killing by k8s during srv shutdown
-	livenessSrv := startLivenessServer(livenessListenAddr)
-	defer shutdownLivenessServer(livenessSrv)
+	readEnvironmentConfig()
+	logEffectiveConfig()
+	go cycleLogLevelOnSignal()
+	go toggleMaintenanceModeOnSignal()
 
 	// Telemetry with OpenCensus
+	var exporter *stackdriver.Exporter
 	if projectName := os.Getenv("GCP_PROJECT"); projectName != "" {
-		exporter, err := stackdriver.NewExporter(stackdriver.Options{ProjectID: projectName})
+		var err error
+		exporter, err = stackdriver.NewExporter(stackdriver.Options{ProjectID: projectName})
 		if err != nil {
-			logger.Fatalf("could not set up tracing stackdriver exporter: %v", err)
+			// Tracing is not essential, so by default keep serving traffic without it
+			if getEnvInt("REQUIRE_TRACING", 0) == 1 {
+				logger.Fatalf("could not set up tracing stackdriver exporter: %v", err)
+			}
+			logger.Warnf("could not set up tracing stackdriver exporter, continuing without tracing: %v", err)
+			exporter = nil
+		} else if adaptiveSampling {
+			// Record all spans, the exporter decides which traces to keep once the requests are done
+			trace.RegisterExporter(newTailSamplingExporter(exporter, traceSampleRate, traceLatencyThreshold, traceErrorStatus))
+		} else {
+			trace.RegisterExporter(exporter)
 		}
-		trace.RegisterExporter(exporter)
 	}
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(0)})
+	if adaptiveSampling {
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	} else {
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(traceSampleRate)})
+	}
 
 	tracingWrapper := func(handler http.Handler) http.Handler {
 		incomingSpanNamer := func(req *http.Request) string {
@@ -143,98 +598,174 @@ func main() {
 		}
 
 		ocHandler := &ochttp.Handler{
-			Propagation:    &propagation.HTTPFormat{},
+			Propagation:    newPropagationFormat(tracePropagation),
 			Handler:        handler,
 			FormatSpanName: incomingSpanNamer,
 		}
+		if tracePropagation == "w3c" {
+			// The fix only applies to the X-Cloud-Trace-Context header
+			return ocHandler
+		}
 		return fixTracingHeader(ocHandler)
 	}
 
-	// Make the server with some sensible default timeouts.
-	srv := http.Server{
-		Addr:         listenAddr,
-		Handler:      tracingWrapper(getRouter()),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
-	}
-
 	// Handle graceful shutdown:
-	// Listen for shutdown signals. If received, wait a few seconds (not during development)
-	// so the upstream k8s service has taken the pod out of rotation and stops sending traffic,
-	// then initiate the server shutdown with some timeout. The server will then finish in-flight
-	// requests during that time, but not accept any new ones. Afterwards, exit the program.
-	allConsClosed := make(chan struct{})
+	// Listen for shutdown signals, and stop the servers once one is received. Only on SIGTERM (not during development),
+	// the servers wait for the traffic to stop before shutting down. On SIGINT (ctrl+c), which is not sent by k8s,
+	// the wait is skipped and the servers shut down immediately. Afterwards, exit the program.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var drain int32
 	go func() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		defer func() {
 			signal.Stop(sigint)
 		}()
-		<-sigint
-		logger.Debugf("received shutdown signal")
-		if !IsDevelopment() {
-			time.Sleep(10 * time.Second)
+		sig := <-sigint
+		if sig == syscall.SIGTERM && !IsDevelopment() {
+			atomic.StoreInt32(&drain, 1)
 		}
-		logger.Debugf("server shutting down...")
+		logger.Debugf("received shutdown signal %v", sig)
+		cancel()
+	}()
+
+	livenessAddress := livenessListenAddr
+	if isLivenessServerDisabled() {
+		logger.Infof("liveness server disabled")
+		livenessAddress = ""
+	}
+
+	if heartbeatInterval > 0 {
+		go logHeartbeats(ctx, heartbeatInterval)
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
+	// The url is validated before routing, so requests for unknown paths are validated as well
+	handler := tracingWrapper(validateURL(urlValidation)(stripPrefix(pathPrefix)(getRouter())))
+	err := Run(ctx, Config{
+		ListenAddresses:       parseListenAddresses(listenAddr),
+		LivenessListenAddress: livenessAddress,
+		Handler:               handler,
+		Drain: func() bool {
+			return atomic.LoadInt32(&drain) == 1
+		},
+		ShutdownTimeout: 20 * time.Second,
+		// The traces of the last requests are flushed while the liveness server still answers
+		AfterShutdown: func() {
+			if exporter != nil {
+				flushTraceExporter(exporter, traceFlushTimeout)
+			}
+		},
+		LivenessShutdownDelay: livenessShutdownDelay,
+	})
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
 
-		if err := srv.Shutdown(ctx); err != nil {
-			logger.Errorf("failed to shut down gracefully: %v", err)
+// logHeartbeats logs a line with some basic stats every interval, until the context is done. It gives a sign of life
+// in the logs of services which receive little traffic.
+func logHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastCount := getRequestCount()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count := getRequestCount()
+			logger.Infow("heartbeat",
+				"uptime", time.Since(processStartTime).Round(time.Second).String(),
+				"goroutines", runtime.NumGoroutine(),
+				"requests", count-lastCount,
+			)
+			lastCount = count
 		}
-		close(allConsClosed)
-	}()
+	}
+}
 
-	// Run server
-	logger.Infof("server listening on %v", listenAddr)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		logger.Fatalf("failed to start server: %v", err)
+// waitForDrain waits for the traffic to the server to stop after it started failing its readiness check.
+// With the "fixed" mode, it waits for the given delay. With the "quiet" mode, it waits until no requests have arrived
+// for the quiet period, but at most for the given delay.
+func waitForDrain(mode string, delay time.Duration, quietPeriod time.Duration) {
+	if mode != "quiet" {
+		logger.Debugf("draining for %v", delay)
+		time.Sleep(delay)
+		return
 	}
 
-	<-allConsClosed
-	logger.Infof("server shut down cleanly")
+	logger.Debugf("draining until no requests arrived for %v, for at most %v", quietPeriod, delay)
+	deadline := time.Now().Add(delay)
+	for time.Since(getLastRequestTime()) < quietPeriod {
+		if time.Now().After(deadline) {
+			logger.Debugf("requests kept arriving, stopped draining after %v", delay)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
+// flushTraceExporter uploads the spans buffered in the exporter, waiting at most for the given timeout
+func flushTraceExporter(exporter *stackdriver.Exporter, timeout time.Duration) {
+	flushed := make(chan struct{})
+	go func() {
+		exporter.Flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		logger.Debugf("trace exporter flushed")
+	case <-time.After(timeout):
+		logger.Warnf("timed out flushing trace exporter after %v", timeout)
+	}
 }
 
 // fixTracingHeader fixes the possibly-incompatible tracing header
 // # See https://github.com/census-ecosystem/opencensus-go-exporter-stackdriver/pull/169
 // # If span_id in the incoming header is a hexadecimal representation, convert it to integer for the go library
+// The header has the form "TRACE_ID/SPAN_ID;o=TRACE_TRUE", where the ";o=TRACE_TRUE" options part is optional.
 func fixTracingHeader(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		httpHeader := "X-Cloud-Trace-Context"
 		if h := r.Header.Get(httpHeader); h != "" {
-
-			// Parse the trace id field.
-			slash := strings.Index(h, `/`)
-			if slash != -1 {
-				tracestr, h := h[:slash], h[slash+1:]
-
-				// Parse the span id field.
-				spanstr := h
-				semicolon := strings.Index(h, `;`)
-				if semicolon != -1 {
-					spanstr, h = h[:semicolon], h[semicolon+1:]
-
-					_, err := strconv.ParseUint(spanstr, 10, 64)
-					// If integer parsing failed, it's hex -> decode it
-					if err != nil {
-						n, err := strconv.ParseUint(spanstr, 16, 64)
-						if err == nil {
-							spanstr = strconv.FormatUint(uint64(uint32(n)), 10)
-						}
-					}
-
-					// Set the new header
-					convertedHeader := fmt.Sprintf("%s/%s;%s", tracestr, spanstr, h)
-					// incomingHeader := r.Header.Get(httpHeader)
-					// logger.Infof("convertedHeader: (%++v) %++v", incomingHeader, convertedHeader)
-					r.Header.Set(httpHeader, convertedHeader)
-				}
-
+			if convertedHeader, ok := convertTracingHeader(h); ok {
+				r.Header.Set(httpHeader, convertedHeader)
 			}
 		}
 		h.ServeHTTP(w, r)
 	})
 }
+
+// convertTracingHeader converts a hexadecimal span id in an X-Cloud-Trace-Context header value to its integer form,
+// keeping the trace id and the trace options (if any) as they are. It returns false if the header is malformed.
+func convertTracingHeader(h string) (string, bool) {
+	// Parse the trace id field.
+	slash := strings.Index(h, `/`)
+	if slash == -1 {
+		return "", false
+	}
+	tracestr, h := h[:slash], h[slash+1:]
+
+	// Parse the span id field, splitting off the options if present.
+	spanstr, options := h, ""
+	if semicolon := strings.Index(h, `;`); semicolon != -1 {
+		spanstr, options = h[:semicolon], h[semicolon:]
+	}
+	if spanstr == "" {
+		return "", false
+	}
+
+	_, err := strconv.ParseUint(spanstr, 10, 64)
+	// If integer parsing failed, it's hex -> decode it
+	if err != nil {
+		n, err := strconv.ParseUint(spanstr, 16, 64)
+		if err == nil {
+			spanstr = strconv.FormatUint(uint64(uint32(n)), 10)
+		}
+	}
+
+	return fmt.Sprintf("%s/%s%s", tracestr, spanstr, options), true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestConvertTracingHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+		ok       bool
+	}{
+		{"hex span id with options", "105445aa7843bc8bf206b12000100000/abcdef;o=1", "105445aa7843bc8bf206b12000100000/11259375;o=1", true},
+		{"hex span id without options", "105445aa7843bc8bf206b12000100000/abcdef", "105445aa7843bc8bf206b12000100000/11259375", true},
+		{"decimal span id with options", "105445aa7843bc8bf206b12000100000/12345;o=0", "105445aa7843bc8bf206b12000100000/12345;o=0", true},
+		{"decimal span id without options", "105445aa7843bc8bf206b12000100000/12345", "105445aa7843bc8bf206b12000100000/12345", true},
+		{"missing slash", "105445aa7843bc8bf206b12000100000", "", false},
+		{"empty span id", "105445aa7843bc8bf206b12000100000/;o=1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converted, ok := convertTracingHeader(tt.header)
+			if converted != tt.expected || ok != tt.ok {
+				t.Errorf("convertTracingHeader(%q) = %q, %v, expected %q, %v", tt.header, converted, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFixTracingHeader(t *testing.T) {
+	var received string
+	h := fixTracingHeader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Cloud-Trace-Context")
+	}))
+
+	for header, expected := range map[string]string{
+		"traceid/ff;o=1": "traceid/255;o=1",
+		"traceid/ff":     "traceid/255",
+		// Malformed headers are passed on untouched
+		"traceid": "traceid",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Cloud-Trace-Context", header)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if received != expected {
+			t.Errorf("header %q was passed on as %q, expected %q", header, received, expected)
+		}
+	}
+}
+
+func TestStrictSlash(t *testing.T) {
+	defer func(strict bool) { strictSlash = strict }(strictSlash)
+
+	tests := []struct {
+		strict   bool
+		path     string
+		status   int
+		location string
+	}{
+		{false, "/call", http.StatusNotFound, ""},
+		{false, "/headers/", http.StatusNotFound, ""},
+		{false, "/headers", http.StatusOK, ""},
+		{true, "/call", http.StatusMovedPermanently, "/call/"},
+		{true, "/headers/", http.StatusMovedPermanently, "/headers"},
+		{true, "/headers", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		strictSlash = tt.strict
+		router := getRouter()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("strict slash %v: GET %v responded with %v, expected %v", tt.strict, tt.path, w.Code, tt.status)
+		}
+		if location := w.Header().Get("Location"); location != tt.location {
+			t.Errorf("strict slash %v: GET %v redirected to %q, expected %q", tt.strict, tt.path, location, tt.location)
+		}
+	}
+}
+
+func TestGetEnvironmentName(t *testing.T) {
+	if value, found := os.LookupEnv("ENVIRONMENT"); found {
+		defer os.Setenv("ENVIRONMENT", value)
+	} else {
+		defer os.Unsetenv("ENVIRONMENT")
+	}
+
+	tests := []struct {
+		name     string
+		set      bool
+		value    string
+		expected string
+	}{
+		{"unset", false, "", "local"},
+		{"empty", true, "", "local"},
+		{"set", true, "staging", "staging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.set {
+				os.Setenv("ENVIRONMENT", tt.value)
+			} else {
+				os.Unsetenv("ENVIRONMENT")
+			}
+			if name := getEnvironmentName("local"); name != tt.expected {
+				t.Errorf("getEnvironmentName(\"local\") = %q, expected %q", name, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandlersWithoutSetupLogger(t *testing.T) {
+	if logger == nil {
+		t.Fatal("logger is nil before setupLogger ran")
+	}
+
+	s := newService("test")
+	tests := []struct {
+		name    string
+		handler http.Handler
+		target  string
+		status  int
+	}{
+		{"index", s.indexHandler(), "/", http.StatusOK},
+		{"call without url", s.callHandler(), "/call/", http.StatusOK},
+		{"logged request", logHTTPRequest()(s.headersHandler()), "/headers", http.StatusOK},
+		{"recovered panic", recoverPanics(true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})), "/panic", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %v, expected %v", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/trace"
+)
+
+// The metrics are kept in memory and exposed in the Prometheus text format on the /metrics endpoint,
+// or in the OpenMetrics format (which adds trace exemplars to the latency histogram) if the scraper accepts it.
+// The format is written here rather than by an exporter: the module only depends on the Stackdriver exporter of
+// opencensus, and its Prometheus exporter can't write exemplars. Only counters and histograms are needed, so this
+// is kept to the small subset of the format they use.
+
+var (
+	defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	httpRequestsTotal = newCounterVec("http_requests_total",
+		"Number of handled HTTP requests.", "method", "path", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"Latency of handled HTTP requests in seconds.", defaultLatencyBuckets, "method", "path")
+
+	outboundRequestsTotal = newCounterVec("outbound_requests_total",
+		"Number of outbound calls made for /call/.", "method")
+	outboundRequestErrorsTotal = newCounterVec("outbound_request_errors_total",
+		"Number of failed outbound calls made for /call/, by category of the error.", "method", "category")
+	outboundRequestDuration = newHistogramVec("outbound_request_duration_seconds",
+		"Latency of outbound calls made for /call/ in seconds.", defaultLatencyBuckets, "method")
+
+	registeredMetrics = []metric{httpRequestsTotal, httpRequestDuration, outboundRequestsTotal, outboundRequestErrorsTotal, outboundRequestDuration}
+)
+
+// metric is a set of series which can write itself in the Prometheus text or the OpenMetrics format
+type metric interface {
+	write(w io.Writer, openMetrics bool)
+}
+
+// counterVec is a counter metric with a series per combination of label values
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	series     map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{name: name, help: help, labelNames: labelNames, series: make(map[string]*counterSeries)}
+}
+
+// inc increments the series with the given label values by one
+func (c *counterVec) inc(labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := c.series[key]
+	if !ok {
+		series = &counterSeries{labelValues: labelValues}
+		c.series[key] = series
+	}
+	series.value++
+}
+
+func (c *counterVec) write(w io.Writer, openMetrics bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// In OpenMetrics, the name of a counter family doesn't include the _total suffix of its samples
+	family := c.name
+	if openMetrics {
+		family = strings.TrimSuffix(c.name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", family, c.help, family)
+	for _, key := range keys {
+		series := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, series.labelValues), formatFloat(series.value))
+	}
+}
+
+// histogramVec is a histogram metric with a series per combination of label values
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues  []string
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+	// exemplars holds the last exemplar of each bucket, with the +Inf bucket last
+	exemplars []*exemplar
+}
+
+// exemplar links an observed value to the trace of the request it was observed for
+type exemplar struct {
+	traceID   string
+	value     float64
+	timestamp time.Time
+}
+
+func (e *exemplar) format() string {
+	if e == nil {
+		return ""
+	}
+	return fmt.Sprintf(" # {trace_id=\"%s\"} %s %.3f", e.traceID, formatFloat(e.value), float64(e.timestamp.UnixNano())/1e9)
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// observe adds a value to the series with the given label values
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.observeWithExemplar(value, "", labelValues...)
+}
+
+// observeWithExemplar adds a value to the series with the given label values, and unless the trace id is empty,
+// keeps it as exemplar of the bucket it falls in
+func (h *histogramVec) observeWithExemplar(value float64, traceID string, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			labelValues:  labelValues,
+			bucketCounts: make([]uint64, len(h.buckets)),
+			exemplars:    make([]*exemplar, len(h.buckets)+1),
+		}
+		h.series[key] = series
+	}
+	exemplarBucket := len(h.buckets)
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.bucketCounts[i]++
+			if i < exemplarBucket {
+				exemplarBucket = i
+			}
+		}
+	}
+	series.count++
+	series.sum += value
+	if traceID != "" {
+		series.exemplars[exemplarBucket] = &exemplar{traceID: traceID, value: value, timestamp: time.Now()}
+	}
+}
+
+func (h *histogramVec) write(w io.Writer, openMetrics bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	bucketLabelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, key := range keys {
+		series := h.series[key]
+		// Exemplars are only part of the OpenMetrics format
+		exemplarOf := func(i int) string {
+			if !openMetrics {
+				return ""
+			}
+			return series.exemplars[i].format()
+		}
+		for i, upperBound := range h.buckets {
+			bucketLabelValues := append(append([]string{}, series.labelValues...), formatFloat(upperBound))
+			fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, formatLabels(bucketLabelNames, bucketLabelValues), series.bucketCounts[i], exemplarOf(i))
+		}
+		infLabelValues := append(append([]string{}, series.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, formatLabels(bucketLabelNames, infLabelValues), series.count, exemplarOf(len(h.buckets)))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, series.labelValues), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, series.labelValues), series.count)
+	}
+}
+
+// formatLabels formats label pairs as {name="value",...}, escaping the values
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// routeLabel returns the path template of the matched mux route (e.g. "/status/{code}") to be used as path label,
+// so the number of series stays bounded regardless of the requested paths. Unmatched requests are labelled "unknown".
+func routeLabel(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if pathTemplate, err := route.GetPathTemplate(); err == nil {
+			return pathTemplate
+		}
+	}
+	return "unknown"
+}
+
+// standardMethods are the HTTP methods which are used as label as is, see methodLabel
+var standardMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// methodLabel returns the method of the request to be used as method label. Clients can send any token as method,
+// so the ones outside the standard set are labelled "OTHER" to keep the number of series bounded.
+func methodLabel(r *http.Request) string {
+	if standardMethods[r.Method] {
+		return r.Method
+	}
+	return "OTHER"
+}
+
+// instrumentRequest records the number and latency of requests in the metrics, labelled by method and route template.
+// The trace id of sampled requests is kept as exemplar of the latency, to jump from a slow bucket to a trace.
+func instrumentRequest() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := statusWriter{ResponseWriter: w}
+			h.ServeHTTP(&sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+
+			method, path := methodLabel(r), routeLabel(r)
+			httpRequestsTotal.inc(method, path, strconv.Itoa(sw.status))
+			traceID := ""
+			if span := trace.FromContext(r.Context()); span != nil && span.SpanContext().IsSampled() {
+				traceID = span.SpanContext().TraceID.String()
+			}
+			httpRequestDuration.observeWithExemplar(time.Since(start).Seconds(), traceID, method, path)
+		})
+	}
+}
+
+// outboundErrorCategory returns the category of the failure of an outbound call, for the metrics: "dns", "connect",
+// "timeout", "queue" (no worker of the pool was available), "status" (a 5xx response) or "other".
+// An empty category is returned for calls which succeeded.
+func outboundErrorCategory(resp *http.Response, err error) string {
+	if err == nil {
+		if resp != nil && resp.StatusCode >= http.StatusInternalServerError {
+			return "status"
+		}
+		return ""
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errOutboundQueueTimeout):
+		return "queue"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	}
+	return "other"
+}
+
+// recordOutboundRequest records an outbound call which took the duration in the metrics
+func recordOutboundRequest(method string, duration time.Duration, result *upstreamResult, err error) {
+	var resp *http.Response
+	if result != nil {
+		resp = result.resp
+	}
+	outboundRequestsTotal.inc(method)
+	outboundRequestDuration.observe(duration.Seconds(), method)
+	if category := outboundErrorCategory(resp, err); category != "" {
+		outboundRequestErrorsTotal.inc(method, category)
+	}
+}
+
+// metricsHandler exposes all metrics in the Prometheus text format, or in the OpenMetrics format if accepted
+func metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		}
+		w.WriteHeader(http.StatusOK)
+		for _, m := range registeredMetrics {
+			m.write(w, openMetrics)
+		}
+		if openMetrics {
+			fmt.Fprint(w, "# EOF\n")
+		}
+	}
+}
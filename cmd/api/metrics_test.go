@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestInstrumentRequestLabelsByRoute(t *testing.T) {
+	defer func(total *counterVec, duration *histogramVec) {
+		httpRequestsTotal, httpRequestDuration = total, duration
+	}(httpRequestsTotal, httpRequestDuration)
+	httpRequestsTotal = newCounterVec("http_requests_total", "", "method", "path", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds", "", defaultLatencyBuckets, "method", "path")
+
+	router := mux.NewRouter()
+	router.Handle("/status/{code}", instrumentRequest()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	router.NotFoundHandler = instrumentRequest()(http.NotFoundHandler())
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/status/200"},
+		{http.MethodGet, "/status/503"},
+		{http.MethodGet, "/status/503"},
+		{http.MethodDelete, "/status/503"},
+		{http.MethodGet, "/nope/1"},
+		{http.MethodGet, "/nope/2"},
+		// Arbitrary method tokens share a single series
+		{"BREW", "/status/200"},
+		{"get", "/status/200"},
+		{"X-RANDOM-1", "/nope/3"},
+	}
+	for _, req := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+
+	expected := map[string]float64{
+		"GET /status/{code} 418":    3,
+		"DELETE /status/{code} 418": 1,
+		"OTHER /status/{code} 418":  2,
+		"GET unknown 404":           2,
+		"OTHER unknown 404":         1,
+	}
+	if len(httpRequestsTotal.series) != len(expected) {
+		t.Errorf("got %v series, expected %v", len(httpRequestsTotal.series), len(expected))
+	}
+	for key, series := range httpRequestsTotal.series {
+		labels := strings.Join(series.labelValues, " ")
+		if value, found := expected[labels]; !found || value != series.value {
+			t.Errorf("series %q has value %v, expected %v", strings.Replace(key, "\xff", " ", -1), series.value, value)
+		}
+	}
+	if len(httpRequestDuration.series) != len(expected) {
+		t.Errorf("got %v latency series, expected %v", len(httpRequestDuration.series), len(expected))
+	}
+}
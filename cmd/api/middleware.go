@@ -1,17 +1,62 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+)
+
+// contextKey is the type of the keys under which middleware stores values in the request context
+type contextKey string
+
+const (
+	loggerContextKey    contextKey = "logger"
+	jwtClaimsContextKey contextKey = "jwtClaims"
+	timingsContextKey   contextKey = "timings"
 )
 
 // adapter type is a wrapper to construct middleware.
 // It takes in a http.Handler and returns a wrapped http.Handler.
 type adapter func(http.Handler) http.Handler
 
+// chain combines a set of middleware (in the form of adapters) into a single adapter, which applies them
+// in the order of their appearance in the arguments: the first one is the outermost, so it sees the request first
+// and the response last. E.g. chain(a, b)(h) handles a request as a -> b -> h.
+func chain(middleware ...adapter) adapter {
+	return func(h http.Handler) http.Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			h = middleware[i](h)
+		}
+		return h
+	}
+}
+
 // adapt takes an http.Handler and applies a set of middleware (in the form of adapters) to it.
 // Note: all middleware is executed in reverse order of their appearance in the arguments to adapt().
+//
+// Deprecated: use chain, which applies the middleware in the order of their appearance.
 func adapt(h http.Handler, middleware ...adapter) http.Handler {
 	for _, middlewareFn := range middleware {
 		h = middlewareFn(h)
@@ -20,35 +65,200 @@ func adapt(h http.Handler, middleware ...adapter) http.Handler {
 }
 
 // statusWriter is a struct implementing the ResponseWriter interface to record some metrics for logging purposes.
+// If set, beforeWriteHeader is called right before the headers are written, to add last-minute headers.
 type statusWriter struct {
 	http.ResponseWriter
-	status int
-	length int
+	status            int
+	length            int
+	beforeWriteHeader func(http.Header)
 }
 
 func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 && w.beforeWriteHeader != nil {
+		w.beforeWriteHeader(w.Header())
+	}
 	w.status = status
 	w.ResponseWriter.WriteHeader(status)
 }
 
 func (w *statusWriter) Write(b []byte) (int, error) {
 	if w.status == 0 {
-		w.status = http.StatusOK
+		w.WriteHeader(http.StatusOK)
 	}
 	n, err := w.ResponseWriter.Write(b)
 	w.length += n
 	return n, err
 }
 
-// logHTTPRequest logs a request in Apache log format, with as additional last number the amount of milliseconds the request took
+// Flush implements http.Flusher if the underlying writer supports it, so streaming handlers keep working
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying writer supports it, so e.g. WebSocket upgrades keep working
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying response writer does not support hijacking")
+	}
+	if w.status == 0 {
+		// The connection is taken over, which is logged as a protocol switch
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// ReadFrom implements io.ReaderFrom, delegating to the underlying writer (e.g. to use sendfile) if it supports it
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	var n int64
+	var err error
+	if readerFrom, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, src)
+	}
+	w.length += int(n)
+	return n, err
+}
+
+// writerOnly hides all methods but Write of a writer, so io.Copy doesn't use its ReadFrom
+type writerOnly struct {
+	io.Writer
+}
+
+// lastRequestTime holds the time (in unix nanoseconds) at which the last request, other than a health check, arrived
+var lastRequestTime int64
+
+// requestCount holds the number of requests, other than health checks, which arrived since startup
+var requestCount int64
+
+// getRequestCount returns the number of requests, other than health checks, which arrived since startup
+func getRequestCount() int64 {
+	return atomic.LoadInt64(&requestCount)
+}
+
+// getLastRequestTime returns the time at which the last request, other than a health check, arrived
+func getLastRequestTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&lastRequestTime))
+}
+
+// requestRegistry keeps track of the requests being handled
+type requestRegistry struct {
+	mutex    sync.Mutex
+	requests map[*http.Request]time.Time
+}
+
+// inFlightRequests holds the requests being handled by the main server, reported on during the graceful shutdown
+var inFlightRequests = &requestRegistry{requests: make(map[*http.Request]time.Time)}
+
+func (rr *requestRegistry) add(r *http.Request) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	rr.requests[r] = time.Now()
+}
+
+func (rr *requestRegistry) remove(r *http.Request) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	delete(rr.requests, r)
+}
+
+func (rr *requestRegistry) count() int {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	return len(rr.requests)
+}
+
+// describe returns the method, url and running time of the requests, longest running first
+func (rr *requestRegistry) describe() []string {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	requests := make([]*http.Request, 0, len(rr.requests))
+	for r := range rr.requests {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return rr.requests[requests[i]].Before(rr.requests[requests[j]])
+	})
+	descriptions := make([]string, len(requests))
+	for i, r := range requests {
+		descriptions[i] = fmt.Sprintf("%v %v (running for %v)", r.Method, r.URL, time.Since(rr.requests[r]).Round(time.Millisecond))
+	}
+	return descriptions
+}
+
+// trackInFlightRequests keeps the requests in the registry while they're being handled
+func trackInFlightRequests(rr *requestRegistry) adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rr.add(r)
+			defer rr.remove(r)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// millisecondsSince returns the amount of whole milliseconds elapsed since the given time
+func millisecondsSince(start time.Time) int64 {
+	return time.Since(start).Nanoseconds() / (int64(time.Millisecond) / int64(time.Nanosecond))
+}
+
+// logHTTPRequest logs a request in Apache log format, with as additional last number the amount of milliseconds the request took.
+// The time until the response headers are written is returned to the client in the X-Response-Time-Ms header.
+// The matched route template (or "unknown" if no route matched) is added as route field, to aggregate logs by route.
 func logHTTPRequest() adapter {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
-			sw := statusWriter{ResponseWriter: w}
+			if r.URL.Path != healthPath && r.URL.Path != readyPath {
+				atomic.StoreInt64(&lastRequestTime, start.UnixNano())
+				atomic.AddInt64(&requestCount, 1)
+			}
+			sw := statusWriter{ResponseWriter: w, beforeWriteHeader: func(header http.Header) {
+				header.Set("X-Response-Time-Ms", strconv.FormatInt(millisecondsSince(start), 10))
+			}}
 			h.ServeHTTP(&sw, r)
-			durationInMilliSeconds := time.Since(start).Nanoseconds() / (int64(time.Millisecond) / int64(time.Nanosecond))
-			logger.Infof("%s - - [%s] \"%s %v %s\" %d %d %d", r.RemoteAddr, time.Now().UTC().Format("02/Jan/2006:03:04:05"), r.Method, r.URL, r.Proto, sw.status, sw.length, durationInMilliSeconds)
+			if sw.status == 0 {
+				// Nothing was written, net/http would send an empty 200 without the X-Response-Time-Ms header
+				sw.WriteHeader(http.StatusOK)
+			}
+			durationInMilliSeconds := millisecondsSince(start)
+			loggerFromContext(r.Context()).With("route", routeLabel(r)).Infof("%s - - [%s] \"%s %v %s\" %d %d %d", r.RemoteAddr, time.Now().UTC().Format("02/Jan/2006:03:04:05"), r.Method, r.URL, r.Proto, sw.status, sw.length, durationInMilliSeconds)
+		})
+	}
+}
+
+// recoverPanics turns a panic in a handler into a 500 response, instead of having net/http close the connection.
+// The panic is logged with the request method and path, and unless disabled, the stack trace.
+func recoverPanics(logStack bool) adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if recovered == http.ErrAbortHandler {
+					// Used to abort a response on purpose, let net/http handle it
+					panic(recovered)
+				}
+				fields := []interface{}{"panic", fmt.Sprint(recovered), "method", r.Method, "path", r.URL.Path}
+				if logStack {
+					fields = append(fields, "stack", string(debug.Stack()))
+				}
+				loggerFromContext(r.Context()).Errorw("recovered from panic in handler", fields...)
+				writeJSONError(w, http.StatusInternalServerError, "ERROR: Internal server error")
+			}()
+			h.ServeHTTP(w, r)
 		})
 	}
 }
@@ -66,3 +276,676 @@ func addRequestTimeout() adapter {
 		})
 	}
 }
+
+// loggerFromContext returns the request-scoped logger stored in the context by addRequestLogger,
+// falling back to the global logger if there is none.
+func loggerFromContext(ctx context.Context) *zap.SugaredLogger {
+	if l, ok := ctx.Value(loggerContextKey).(*zap.SugaredLogger); ok {
+		return l
+	}
+	return logger
+}
+
+// newRequestID returns a random hex identifier for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// addRequestLogger stores a logger in the request context which tags all its log lines with the request id
+// (taken from the X-Request-Id header if present, e.g. set by istio) and the trace id of the request.
+func addRequestLogger() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-Id")
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			requestLogger := logger.With("requestId", requestID)
+			if span := trace.FromContext(r.Context()); span != nil {
+				requestLogger = requestLogger.With("traceId", span.SpanContext().TraceID.String())
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), loggerContextKey, requestLogger))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isSecureRequest returns whether the request was made over https, either directly or to a proxy in front of the server
+func isSecureRequest(r *http.Request) bool {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return strings.EqualFold(proto, "https")
+	}
+	return r.TLS != nil
+}
+
+// redirectHTTPS redirects requests made over plain http to the same url with the https scheme, with a 301.
+// If not enabled, requests are passed through, e.g. when a TLS terminating proxy in front already takes care of this.
+func redirectHTTPS(enabled bool) adapter {
+	return func(h http.Handler) http.Handler {
+		if !enabled {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isSecureRequest(r) {
+				// The original request uri still includes the path prefix, which is stripped from the url
+				requestURI := r.RequestURI
+				if requestURI == "" {
+					requestURI = r.URL.RequestURI()
+				} else if u, err := url.ParseRequestURI(requestURI); err == nil && u.IsAbs() {
+					// An absolute-form request uri (e.g. "GET http://host/path") already holds the host
+					requestURI = u.RequestURI()
+				}
+				http.Redirect(w, r, "https://"+r.Host+requestURI, http.StatusMovedPermanently)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// serverTimings accumulates the durations of the phases of handling a request (e.g. calling an upstream),
+// returned to the client in the Server-Timing header
+type serverTimings struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+// recordServerTiming adds the duration of a phase to the Server-Timing header of the request, if tracked
+func recordServerTiming(ctx context.Context, name string, duration time.Duration) {
+	timings, ok := ctx.Value(timingsContextKey).(*serverTimings)
+	if !ok {
+		return
+	}
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+	timings.entries = append(timings.entries, formatServerTiming(name, duration))
+}
+
+// formatServerTiming formats a metric of the Server-Timing header, with the duration in milliseconds
+func formatServerTiming(name string, duration time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(duration)/float64(time.Millisecond))
+}
+
+// addServerTiming returns the durations recorded by the handler with recordServerTiming and the total time
+// until the response headers are written in the Server-Timing header, which browsers show in their dev tools.
+func addServerTiming() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			timings := &serverTimings{}
+			sw := statusWriter{ResponseWriter: w, beforeWriteHeader: func(header http.Header) {
+				timings.mutex.Lock()
+				defer timings.mutex.Unlock()
+				entries := append(timings.entries, formatServerTiming("total", time.Since(start)))
+				header.Set("Server-Timing", strings.Join(entries, ", "))
+			}}
+			h.ServeHTTP(&sw, r.WithContext(context.WithValue(r.Context(), timingsContextKey, timings)))
+		})
+	}
+}
+
+// addTraceIDHeader returns the trace id of the request in the X-Trace-Id response header, so users can look up
+// the trace in the tracing dashboard. The header is omitted if the request has no span.
+func addTraceIDHeader() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if span := trace.FromContext(r.Context()); span != nil {
+				w.Header().Set("X-Trace-Id", span.SpanContext().TraceID.String())
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseDefaultHeaders parses a comma-separated list of name=value pairs of headers (e.g. "X-Environment=prod")
+func parseDefaultHeaders(spec string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected name=value", pair)
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// defaultHeaders sets the given headers on all responses before the handler runs, so handlers can still override them
+func defaultHeaders(headers map[string]string) adapter {
+	return func(h http.Handler) http.Handler {
+		if len(headers) == 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// stripPrefix removes the given prefix from the path of requests, so the server can be served under a base path
+// (e.g. behind a gateway routing "/inspector/*" to it). Requests without the prefix are passed on untouched,
+// so probes hitting the health endpoints directly keep working.
+func stripPrefix(prefix string) adapter {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(h http.Handler) http.Handler {
+		if prefix == "" {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+			if r.URL.RawPath != "" {
+				r2.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.RawPath, prefix), "/")
+			}
+			h.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// newJWTKeyfunc returns the function providing the key to verify JWT signatures with: the secret for HS256 tokens,
+// or the PEM encoded public key for RS256 tokens. It returns nil if neither is given.
+func newJWTKeyfunc(secret string, publicKeyPEM string) (jwt.Keyfunc, error) {
+	if secret == "" && publicKeyPEM == "" {
+		return nil, nil
+	}
+
+	var publicKey interface{}
+	if publicKeyPEM != "" {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %v", err)
+		}
+		publicKey = key
+	}
+
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method {
+		case jwt.SigningMethodHS256:
+			if secret != "" {
+				return []byte(secret), nil
+			}
+		case jwt.SigningMethodRS256:
+			if publicKey != nil {
+				return publicKey, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}, nil
+}
+
+// jwtAuth verifies the JWT bearer token in the Authorization header with the key given by the keyfunc,
+// rejecting requests without a valid token with a 401. The claims of valid tokens are stored in the request context.
+// If queryParam is not empty, requests without Authorization header can pass the token in that query param instead,
+// for clients which can't set headers (e.g. browsers opening a WebSocket).
+// If the keyfunc is nil, requests are passed through unverified.
+func jwtAuth(keyfunc jwt.Keyfunc, queryParam string) adapter {
+	return func(h http.Handler) http.Handler {
+		if keyfunc == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := ""
+			if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+				token = strings.TrimPrefix(authorization, "Bearer ")
+			} else if queryParam != "" && authorization == "" {
+				token = r.URL.Query().Get(queryParam)
+			}
+			if token == "" {
+				writeJSONError(w, http.StatusUnauthorized, "ERROR: Missing bearer token")
+				return
+			}
+
+			claims := jwt.MapClaims{}
+			if _, err := jwt.ParseWithClaims(token, claims, keyfunc); err != nil {
+				writeJSONError(w, http.StatusUnauthorized, fmt.Sprintf("ERROR: Invalid token: %v", err))
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), jwtClaimsContextKey, claims))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// addSpanAttributes adds structured attributes describing the request and response to the trace span of the request,
+// if there is one in the context.
+func addSpanAttributes() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := trace.FromContext(r.Context())
+			if span == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			sw := statusWriter{ResponseWriter: w}
+			h.ServeHTTP(&sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			span.AddAttributes(
+				trace.StringAttribute("http.method", r.Method),
+				trace.StringAttribute("http.route", routeLabel(r)),
+				trace.Int64Attribute("http.status_code", int64(sw.status)),
+				trace.Int64Attribute("http.request_size", r.ContentLength),
+				trace.Int64Attribute("http.response_size", int64(sw.length)),
+			)
+		})
+	}
+}
+
+// headWriter is a ResponseWriter for HEAD requests, which counts the body written by the handler instead of sending it.
+// The headers are only written when the handler is done, so the Content-Length can be determined.
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (w *headWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.length += len(b)
+	return len(b), nil
+}
+
+// Flush implements http.Flusher. The body is discarded and the headers are only written once the handler is done,
+// so there is nothing to flush.
+func (w *headWriter) Flush() {}
+
+// Hijack implements http.Hijacker if the underlying writer supports it
+func (w *headWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// ReadFrom implements io.ReaderFrom, discarding the data
+func (w *headWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(ioutil.Discard, src)
+	w.length += int(n)
+	return n, err
+}
+
+// handleHeadRequests makes handlers answer HEAD requests with the same headers as for a GET request,
+// including the Content-Length of the body they would have returned, but without the body itself.
+func handleHeadRequests() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodHead {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			hw := headWriter{ResponseWriter: w}
+			h.ServeHTTP(&hw, r)
+			if hw.status == 0 {
+				hw.status = http.StatusOK
+			}
+			if w.Header().Get("Content-Length") == "" && hw.status >= http.StatusOK &&
+				hw.status != http.StatusNoContent && hw.status != http.StatusNotModified {
+				w.Header().Set("Content-Length", strconv.Itoa(hw.length))
+			}
+			w.WriteHeader(hw.status)
+		})
+	}
+}
+
+// recentRequest is the summary of a handled request kept in a requestRing
+type recentRequest struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// requestRing is a bounded, concurrency-safe ring buffer holding the most recent requests
+type requestRing struct {
+	mutex    sync.Mutex
+	requests []recentRequest
+	next     int
+	full     bool
+}
+
+func newRequestRing(size int) *requestRing {
+	if size < 1 {
+		size = 1
+	}
+	return &requestRing{requests: make([]recentRequest, size)}
+}
+
+// add stores a request, overwriting the oldest one if the buffer is full
+func (rr *requestRing) add(request recentRequest) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.requests[rr.next] = request
+	rr.next = (rr.next + 1) % len(rr.requests)
+	if rr.next == 0 {
+		rr.full = true
+	}
+}
+
+// list returns the stored requests, from the oldest to the most recent
+func (rr *requestRing) list() []recentRequest {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if !rr.full {
+		return append([]recentRequest{}, rr.requests[:rr.next]...)
+	}
+	return append(append([]recentRequest{}, rr.requests[rr.next:]...), rr.requests[:rr.next]...)
+}
+
+// recordRecentRequests adds a summary of every handled request to the ring buffer
+func recordRecentRequests(rr *requestRing) adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := statusWriter{ResponseWriter: w}
+			h.ServeHTTP(&sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			rr.add(recentRequest{
+				Timestamp:  start.UTC(),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     sw.status,
+				DurationMs: millisecondsSince(start),
+			})
+		})
+	}
+}
+
+// maintenanceMode is set to 1 when the server is in maintenance mode, see rejectDuringMaintenance
+var maintenanceMode int32
+
+// isInMaintenanceMode returns if the server is in maintenance mode
+func isInMaintenanceMode() bool {
+	return atomic.LoadInt32(&maintenanceMode) == 1
+}
+
+// setMaintenanceMode turns maintenance mode on or off
+func setMaintenanceMode(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&maintenanceMode, value)
+}
+
+// rejectDuringMaintenance responds with a 503 while the server is in maintenance mode, to shed load without killing the pod
+func rejectDuringMaintenance() adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isInMaintenanceMode() {
+				writeJSONError(w, http.StatusServiceUnavailable, "ERROR: Server is in maintenance mode")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireHeader rejects requests which don't carry the header with the given value with a 403.
+// The value is compared in constant time, as it's typically a shared secret. If the value is empty, requests are passed through.
+func requireHeader(name string, value string) adapter {
+	return func(h http.Handler) http.Handler {
+		if value == "" {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(name)), []byte(value)) != 1 {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("ERROR: Missing or invalid %v header", name))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// errDecompressedBodyTooLarge is returned when reading a decompressed request body exceeding the allowed size
+var errDecompressedBodyTooLarge = errors.New("decompressed request body too large")
+
+// decompressedBody reads the decompressed request body, failing once more than max bytes have been read,
+// to guard against decompression bombs
+type decompressedBody struct {
+	reader *gzip.Reader
+	body   io.ReadCloser
+	read   int64
+	max    int64
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	if b.read > b.max {
+		return 0, errDecompressedBodyTooLarge
+	}
+	// Read at most one byte beyond the limit, which is enough to detect an oversized body
+	if allowed := b.max - b.read + 1; int64(len(p)) > allowed {
+		p = p[:allowed]
+	}
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if b.read > b.max {
+		// Only the bytes up to the limit are returned
+		if n -= int(b.read - b.max); n < 0 {
+			n = 0
+		}
+		return n, errDecompressedBodyTooLarge
+	}
+	return n, err
+}
+
+func (b *decompressedBody) Close() error {
+	b.reader.Close()
+	return b.body.Close()
+}
+
+// decompressRequest transparently decompresses gzip encoded request bodies, and removes the Content-Encoding header
+// so handlers see a plain body. Reading more than maxBytes of decompressed data fails.
+func decompressRequest(maxBytes int64) adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+				h.ServeHTTP(w, r)
+				return
+			}
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid gzip request body: %v", err))
+				return
+			}
+			r.Body = &decompressedBody{reader: reader, body: r.Body, max: maxBytes}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isAllowedHost returns whether the host (without port) matches one of the allowed patterns: either exactly
+// (case insensitive), or as subdomain of a wildcard pattern like "*.example.com"
+func isAllowedHost(host string, allowed []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHost rejects requests with a Host header which doesn't match one of the allowed patterns with a 400,
+// as it could be spoofed when building urls from it. If no hosts are given, requests are passed through.
+func validateHost(allowed []string) adapter {
+	return func(h http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isAllowedHost(r.Host, allowed) {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Host %q is not allowed", r.Host))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// containsControlCharacters returns whether the string contains ASCII control characters (e.g. a null byte)
+func containsControlCharacters(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// validateURLEncoding returns why the url of the request is invalid for the given mode, or an empty string if it's valid.
+// In the "utf8" mode, the decoded path and query must be valid UTF-8. The "strict" mode also rejects malformed
+// query strings (e.g. invalid percent-encodings) and control characters.
+func validateURLEncoding(u *url.URL, mode string) string {
+	if !utf8.ValidString(u.Path) {
+		return "path is not valid UTF-8"
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil && mode == "strict" {
+		return fmt.Sprintf("malformed query: %v", err)
+	}
+	for key, values := range query {
+		for _, s := range append([]string{key}, values...) {
+			if !utf8.ValidString(s) {
+				return "query is not valid UTF-8"
+			}
+			if mode == "strict" && containsControlCharacters(s) {
+				return "query contains control characters"
+			}
+		}
+	}
+	if mode == "strict" && containsControlCharacters(u.Path) {
+		return "path contains control characters"
+	}
+	return ""
+}
+
+// validateURL rejects requests with a url which is invalid for the given mode (see validateURLEncoding) with a 400,
+// before it reaches the handlers and logging. In the "off" mode, requests are passed through.
+func validateURL(mode string) adapter {
+	return func(h http.Handler) http.Handler {
+		if mode == "off" {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if reason := validateURLEncoding(r.URL, mode); reason != "" {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid url: %v", reason))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// paramRule describes a query param accepted by an endpoint
+type paramRule struct {
+	name     string
+	required bool
+	// validate returns why the value is invalid, or nil if it's valid
+	validate func(value string) error
+}
+
+// paramCountError is returned by validateParams for a param which is given more than once
+type paramCountError struct {
+	name  string
+	count int
+}
+
+func (e *paramCountError) Error() string {
+	return fmt.Sprintf("expected a single %v param, got %v", e.name, e.count)
+}
+
+// validateParams checks the query params against the rules: required params must be given, and all given ones
+// exactly once and with a valid value
+func validateParams(query url.Values, rules []paramRule) error {
+	for _, rule := range rules {
+		values, found := query[rule.name]
+		if !found {
+			if rule.required {
+				return fmt.Errorf("missing %v param", rule.name)
+			}
+			continue
+		}
+		if len(values) != 1 {
+			return &paramCountError{name: rule.name, count: len(values)}
+		}
+		if rule.validate != nil {
+			if err := rule.validate(values[0]); err != nil {
+				return fmt.Errorf("invalid %v param: %v", rule.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// requireValidParams rejects requests whose query params don't satisfy the rules with a 400, before reaching the handler.
+// For a param given more than once, the error also holds the param and the number of times it was given.
+func requireValidParams(rules ...paramRule) adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := validateParams(r.URL.Query(), rules); err != nil {
+				response := setJSONError(make(map[string]interface{}), http.StatusBadRequest, fmt.Sprintf("ERROR: %v", err))
+				var countErr *paramCountError
+				if errors.As(err, &countErr) {
+					response["param"] = countErr.name
+					response["count"] = countErr.count
+				}
+				writeJSON(w, r, http.StatusBadRequest, response)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/trace"
+)
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		path     string
+		expected string
+	}{
+		{"/inspector", "/inspector/call/", "/call/"},
+		{"/inspector/", "/inspector/call/", "/call/"},
+		{"/inspector", "/inspector", "/"},
+		{"/inspector", "/inspector/", "/"},
+		// Paths without the prefix, like direct health probes, are untouched
+		{"/inspector", "/_ah/health/", "/_ah/health/"},
+		{"/inspector", "/inspectors/call/", "/inspectors/call/"},
+		{"", "/call/", "/call/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix+" "+tt.path, func(t *testing.T) {
+			var path string
+			h := stripPrefix(tt.prefix)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if path != tt.expected {
+				t.Errorf("path %q was passed on as %q, expected %q", tt.path, path, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStripPrefixRoutes(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	router.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {})
+	h := stripPrefix("/inspector")(router)
+
+	for path, expected := range map[string]int{
+		"/inspector/status/202":   http.StatusAccepted,
+		"/inspector" + healthPath: http.StatusOK,
+		healthPath:                http.StatusOK,
+		"/status/202":             http.StatusAccepted,
+		"/other/status/202":       http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != expected {
+			t.Errorf("GET %v responded with %v, expected %v", path, w.Code, expected)
+		}
+	}
+}
+
+// tracingAdapter returns middleware which records its name in calls when it sees the request and the response
+func tracingAdapter(name string, calls *[]string) adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name+" in")
+			h.ServeHTTP(w, r)
+			*calls = append(*calls, name+" out")
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	})
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		expected []string
+	}{
+		{
+			"chain applies first to last",
+			chain(tracingAdapter("a", &calls), tracingAdapter("b", &calls), tracingAdapter("c", &calls))(handler),
+			[]string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"},
+		},
+		{
+			"adapt applies last to first",
+			adapt(handler, tracingAdapter("a", &calls), tracingAdapter("b", &calls), tracingAdapter("c", &calls)),
+			[]string{"c in", "b in", "a in", "handler", "a out", "b out", "c out"},
+		},
+		{
+			"nested chains",
+			chain(tracingAdapter("a", &calls), chain(tracingAdapter("b", &calls), tracingAdapter("c", &calls)))(handler),
+			[]string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"},
+		},
+		{"empty chain", chain()(handler), []string{"handler"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			tt.handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			if !reflect.DeepEqual(calls, tt.expected) {
+				t.Errorf("calls %q, expected %q", calls, tt.expected)
+			}
+		})
+	}
+}
+
+func TestResponseTimeHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		minimum int64
+	}{
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) }, 0},
+		{"implicit status", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }, 0},
+		{"flushed", func(w http.ResponseWriter, r *http.Request) { w.(http.Flusher).Flush() }, 0},
+		{"empty response", func(w http.ResponseWriter, r *http.Request) {}, 0},
+		{"slow", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("ok"))
+		}, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			logHTTPRequest()(tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			header := w.Result().Header.Get("X-Response-Time-Ms")
+			ms, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || ms < tt.minimum {
+				t.Errorf("X-Response-Time-Ms is %q, expected a number of at least %v", header, tt.minimum)
+			}
+		})
+	}
+}
+
+func TestHandleHeadRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		handler       http.HandlerFunc
+		status        int
+		contentLength string
+		body          string
+	}{
+		{"json body", http.MethodHead, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, r, http.StatusOK, map[string]string{"hello": "world"})
+		}, http.StatusOK, "18", ""},
+		{"copied body", http.MethodHead, func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, strings.NewReader("0123456789"))
+		}, http.StatusOK, "10", ""},
+		{"explicit content length", http.MethodHead, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1000")
+			w.WriteHeader(http.StatusPartialContent)
+		}, http.StatusPartialContent, "1000", ""},
+		{"no content", http.MethodHead, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}, http.StatusNoContent, "", ""},
+		{"get is untouched", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("body"))
+		}, http.StatusOK, "", "body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleHeadRequests()(tt.handler).ServeHTTP(w, httptest.NewRequest(tt.method, "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %v, expected %v", w.Code, tt.status)
+			}
+			if contentLength := w.Header().Get("Content-Length"); contentLength != tt.contentLength {
+				t.Errorf("Content-Length %q, expected %q", contentLength, tt.contentLength)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body %q, expected %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecompressRequest(t *testing.T) {
+	const maxBytes = 1 << 10
+	bomb := bytes.Repeat([]byte{0}, 10<<20)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		// oneByte reads the body one byte at a time, to check the limit with small buffers
+		oneByte  bool
+		status   int
+		expected []byte
+		tooLarge bool
+	}{
+		{"plain body", "", []byte("hello"), false, http.StatusOK, []byte("hello"), false},
+		{"gzip body", "gzip", gzipped(t, []byte("hello")), false, http.StatusOK, []byte("hello"), false},
+		{"case insensitive encoding", " GZIP", gzipped(t, []byte("hello")), false, http.StatusOK, []byte("hello"), false},
+		{"exactly the limit", "gzip", gzipped(t, bomb[:maxBytes]), false, http.StatusOK, bomb[:maxBytes], false},
+		{"decompression bomb", "gzip", gzipped(t, bomb), false, http.StatusOK, bomb[:maxBytes], true},
+		{"decompression bomb read byte by byte", "gzip", gzipped(t, bomb), true, http.StatusOK, bomb[:maxBytes], true},
+		{"invalid gzip", "gzip", []byte("not gzip"), false, http.StatusBadRequest, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			var readErr error
+			var encoding string
+			h := decompressRequest(maxBytes)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoding = r.Header.Get("Content-Encoding")
+				var reader io.Reader = r.Body
+				if tt.oneByte {
+					reader = iotest.OneByteReader(r.Body)
+				}
+				body, readErr = ioutil.ReadAll(reader)
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/request", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %v, expected %v", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if encoding != "" {
+				t.Errorf("handler saw Content-Encoding %q, expected it to be removed", encoding)
+			}
+			if !bytes.Equal(body, tt.expected) {
+				t.Errorf("handler read %v bytes, expected %v", len(body), len(tt.expected))
+			}
+			if tooLarge := errors.Is(readErr, errDecompressedBodyTooLarge); tooLarge != tt.tooLarge || (!tooLarge && readErr != nil) {
+				t.Errorf("read error %v, expected too large: %v", readErr, tt.tooLarge)
+			}
+		})
+	}
+}
+
+func TestAddTraceIDHeader(t *testing.T) {
+	traceID := trace.TraceID{0x10, 0x54, 0x45, 0xaa, 0x78, 0x43, 0xbc, 0x8b, 0xf2, 0x06, 0xb1, 0x20, 0x00, 0x10, 0x00, 0x00}
+	remoteParent := trace.SpanContext{TraceID: traceID, SpanID: trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8}, TraceOptions: 1}
+
+	tests := []struct {
+		name     string
+		ctx      func() context.Context
+		expected string
+	}{
+		{"no span", context.Background, ""},
+		{"span continuing a remote trace", func() context.Context {
+			ctx, _ := trace.StartSpanWithRemoteParent(context.Background(), "test", remoteParent)
+			return ctx
+		}, "105445aa7843bc8bf206b12000100000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(tt.ctx())
+			addTraceIDHeader()(http.NotFoundHandler()).ServeHTTP(w, r)
+			if header := w.Header().Get("X-Trace-Id"); header != tt.expected {
+				t.Errorf("X-Trace-Id %q, expected %q", header, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		name           string
+		target         string
+		enabled        bool
+		direct         bool
+		forwardedProto string
+		location       string
+	}{
+		{"direct http", "/call/?url=x", true, false, "", "https://example.com/call/?url=x"},
+		{"direct http with absolute request uri", "http://example.com/call/?url=x", true, false, "", "https://example.com/call/?url=x"},
+		{"direct https", "/call/?url=x", true, true, "", ""},
+		{"http to the proxy", "/call/?url=x", true, true, "http", "https://example.com/call/?url=x"},
+		{"https to the proxy", "/call/?url=x", true, false, "https", ""},
+		{"https to the proxy in capitals", "/call/?url=x", true, false, "HTTPS", ""},
+		{"disabled", "/call/?url=x", false, false, "http", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.direct {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.forwardedProto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			}
+			w := httptest.NewRecorder()
+			redirectHTTPS(tt.enabled)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+
+			if tt.location == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("status %v, expected the request to be passed on", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.location {
+				t.Errorf("status %v and location %q, expected a 301 to %q", w.Code, w.Header().Get("Location"), tt.location)
+			}
+		})
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		write   func(w *statusWriter)
+		status  int
+		length  int
+		flushed bool
+	}{
+		{"implicit status", func(w *statusWriter) { w.Write([]byte("hello")) }, http.StatusOK, 5, false},
+		{"flush before writing", func(w *statusWriter) {
+			w.Flush()
+			w.Write([]byte("hello"))
+		}, http.StatusOK, 5, true},
+		{"flush after status", func(w *statusWriter) {
+			w.WriteHeader(http.StatusAccepted)
+			w.Flush()
+		}, http.StatusAccepted, 0, true},
+		{"read from", func(w *statusWriter) { io.Copy(w, strings.NewReader("0123456789")) }, http.StatusOK, 10, false},
+		{"read from after status", func(w *statusWriter) {
+			w.WriteHeader(http.StatusCreated)
+			w.ReadFrom(strings.NewReader("abc"))
+		}, http.StatusCreated, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			sw := &statusWriter{ResponseWriter: recorder}
+			tt.write(sw)
+			if sw.status != tt.status || recorder.Code != tt.status {
+				t.Errorf("recorded status %v and sent %v, expected %v", sw.status, recorder.Code, tt.status)
+			}
+			if sw.length != tt.length || recorder.Body.Len() != tt.length {
+				t.Errorf("recorded length %v and sent %v bytes, expected %v", sw.length, recorder.Body.Len(), tt.length)
+			}
+			if recorder.Flushed != tt.flushed {
+				t.Errorf("flushed %v, expected %v", recorder.Flushed, tt.flushed)
+			}
+		})
+	}
+}
+
+func TestStatusWriterHijack(t *testing.T) {
+	// A recorder can't be hijacked, which is reported instead of panicking
+	if _, _, err := (&statusWriter{ResponseWriter: httptest.NewRecorder()}).Hijack(); err == nil {
+		t.Errorf("hijacking a writer without support for it succeeded")
+	}
+
+	statuses := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		conn, buffer, err := sw.Hijack()
+		statuses <- sw.status
+		if err != nil {
+			t.Errorf("failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nhijacked")
+		buffer.Flush()
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read the response of the hijacked connection: %v", err)
+	}
+	// After switching protocols, the rest of the connection is no longer http
+	body, _ := ioutil.ReadAll(reader)
+	if resp.StatusCode != http.StatusSwitchingProtocols || string(body) != "hijacked" {
+		t.Errorf("got status %v and body %q from the hijacked connection", resp.StatusCode, body)
+	}
+	if status := <-statuses; status != http.StatusSwitchingProtocols {
+		t.Errorf("recorded status %v for the hijacked connection, expected %v", status, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	// The expected status for each of the modes off, utf8 and strict
+	tests := []struct {
+		target   string
+		expected [3]int
+	}{
+		{"/caf%C3%A9?name=%C3%A9t%C3%A9", [3]int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"/%ff", [3]int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest}},
+		{"/?q=%e2%28%a1", [3]int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest}},
+		{"/?%c3%28=value", [3]int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest}},
+		{"/?q=%zz", [3]int{http.StatusOK, http.StatusOK, http.StatusBadRequest}},
+		{"/?q=a%00b", [3]int{http.StatusOK, http.StatusOK, http.StatusBadRequest}},
+		{"/a%07b", [3]int{http.StatusOK, http.StatusOK, http.StatusBadRequest}},
+	}
+	for _, tt := range tests {
+		for i, mode := range []string{"off", "utf8", "strict"} {
+			w := httptest.NewRecorder()
+			validateURL(mode)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.expected[i] {
+				t.Errorf("mode %v: GET %v responded with %v, expected %v", mode, tt.target, w.Code, tt.expected[i])
+			}
+		}
+	}
+}
+
+func TestParseDefaultHeaders(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected map[string]string
+		err      bool
+	}{
+		{"", map[string]string{}, false},
+		{"X-Service-Name=inspector", map[string]string{"X-Service-Name": "inspector"}, false},
+		{" x-environment = prod , X-Team=platform,", map[string]string{"X-Environment": "prod", "X-Team": "platform"}, false},
+		{"X-Query=a=b", map[string]string{"X-Query": "a=b"}, false},
+		{"X-Empty=", map[string]string{"X-Empty": ""}, false},
+		{"X-Missing-Value", nil, true},
+		{"=value", nil, true},
+	}
+	for _, tt := range tests {
+		headers, err := parseDefaultHeaders(tt.spec)
+		if (err != nil) != tt.err || !reflect.DeepEqual(headers, tt.expected) {
+			t.Errorf("parseDefaultHeaders(%q) = %v, %v, expected %v and an error: %v", tt.spec, headers, err, tt.expected, tt.err)
+		}
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	defer func(headers map[string]string) { responseHeaders = headers }(responseHeaders)
+	responseHeaders = map[string]string{"X-Service-Name": "inspector", "X-Environment": "test"}
+
+	// Handlers can override the default headers
+	overriding := defaultHeaders(responseHeaders)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Environment", "overridden")
+	}))
+	w := httptest.NewRecorder()
+	overriding.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Header().Get("X-Service-Name") != "inspector" || w.Header().Get("X-Environment") != "overridden" {
+		t.Errorf("headers %v, expected the default X-Service-Name and the overridden X-Environment", w.Header())
+	}
+
+	// All responses of the router get them, including health checks and errors
+	router := getRouter()
+	for _, path := range []string{"/headers", healthPath, "/does-not-exist", "/status/500"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		for name, value := range responseHeaders {
+			if w.Header().Get(name) != value {
+				t.Errorf("GET %v: header %v is %q, expected %q", path, name, w.Header().Get(name), value)
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// fileDescriptorLimits reports that the limits of open file descriptors can't be read on this platform
+func fileDescriptorLimits() (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("file descriptor limits are not available on %v", runtime.GOOS)
+}
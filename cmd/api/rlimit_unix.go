@@ -0,0 +1,15 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "syscall"
+
+// fileDescriptorLimits returns the soft and hard limit of the number of open file descriptors of the process
+func fileDescriptorLimits() (uint64, uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0, err
+	}
+	return uint64(limit.Cur), uint64(limit.Max), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings of the servers started by Run
+type Config struct {
+	// ListenAddresses are the addresses of the main servers, which all serve the same handler
+	ListenAddresses []string
+	// LivenessListenAddress is the address of the separate liveness server. It is not started when empty.
+	LivenessListenAddress string
+	// Handler serves the requests to the main servers
+	Handler http.Handler
+	// Drain is called once the context is done, and returns whether to wait for the traffic to stop
+	// before shutting down the servers. When nil, the servers are shut down immediately.
+	Drain func() bool
+	// ShutdownTimeout is the time in-flight requests get to finish during the shutdown
+	ShutdownTimeout time.Duration
+	// AfterShutdown is called once the main servers are shut down, but before the liveness server is, e.g. to
+	// flush the traces of the last requests. It may be nil.
+	AfterShutdown func()
+	// LivenessShutdownDelay is the time the liveness server keeps answering after the main servers are shut down,
+	// when draining
+	LivenessShutdownDelay time.Duration
+}
+
+// Run starts the servers and handles their graceful shutdown once the context is done. It returns when all servers
+// are shut down, with an error if one of them could not be started or failed while serving.
+//
+// The shutdown happens in this order:
+//  1. the readiness check starts failing, while the liveness check keeps passing
+//  2. if the config asks to drain, Run waits a few seconds so the upstream k8s service has taken the pod out of
+//     rotation and stops sending traffic
+//  3. the main servers are shut down with a timeout, during which they finish in-flight requests but don't accept
+//     any new ones. Open WebSocket connections are sent a close frame. The requests in flight are logged,
+//     as well as the ones which are force closed when the timeout expires.
+//  4. AfterShutdown is called (e.g. to flush the traces)
+//  5. when draining, the liveness server keeps answering for LivenessShutdownDelay, and is shut down last,
+//     to avoid premature killing by k8s
+func Run(ctx context.Context, cfg Config) error {
+	if len(cfg.ListenAddresses) == 0 {
+		return errors.New("no listen address given")
+	}
+
+	// The deferred calls run in reverse order, so the liveness server is shut down after everything else
+	var drain bool
+	if cfg.LivenessListenAddress != "" {
+		livenessSrv, err := startLivenessServer(cfg.LivenessListenAddress)
+		if err != nil {
+			return fmt.Errorf("failed to start liveness server: %v", err)
+		}
+		defer func() {
+			if drain && cfg.LivenessShutdownDelay > 0 {
+				logger.Debugf("keeping the liveness server up for %v", cfg.LivenessShutdownDelay)
+				time.Sleep(cfg.LivenessShutdownDelay)
+			}
+			shutdownLivenessServer(livenessSrv)
+		}()
+	}
+	if cfg.AfterShutdown != nil {
+		defer cfg.AfterShutdown()
+	}
+
+	// Make a server with some sensible default timeouts for each of the listen addresses, all sharing the same handler.
+	servers := make([]*http.Server, len(cfg.ListenAddresses))
+	listeners := make([]net.Listener, len(cfg.ListenAddresses))
+	for i, address := range cfg.ListenAddresses {
+		servers[i] = &http.Server{
+			Addr:              address,
+			Handler:           cfg.Handler,
+			ReadTimeout:       serverTimeouts.read,
+			ReadHeaderTimeout: serverTimeouts.readHeader,
+			WriteTimeout:      serverTimeouts.write,
+			IdleTimeout:       serverTimeouts.idle,
+			MaxHeaderBytes:    maxHeaderBytes,
+		}
+
+		// Bind the addresses before serving, so Run fails fast if one is unavailable (e.g. already in use)
+		var err error
+		listeners[i], err = net.Listen("tcp", address)
+		if err != nil {
+			for _, listener := range listeners[:i] {
+				listener.Close()
+			}
+			return fmt.Errorf("failed to start server on %v: %v", address, err)
+		}
+	}
+
+	serveErrors := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, listener net.Listener) {
+			logger.Infof("server listening on %v", srv.Addr)
+			if err := srv.Serve(listener); err != http.ErrServerClosed {
+				serveErrors <- fmt.Errorf("server on %v failed: %v", srv.Addr, err)
+			}
+		}(srv, listeners[i])
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		drain = cfg.Drain != nil && cfg.Drain()
+		logger.Debugf("shutting down, draining: %v", drain)
+		// Fail the readiness check, so k8s takes the pod out of rotation
+		setShuttingDown()
+		if drain {
+			waitForDrain(drainMode, drainDelay, drainQuietPeriod)
+		}
+	case serveErr = <-serveErrors:
+		logger.Errorf("%v, shutting down the other servers", serveErr)
+	}
+	logger.Debugf("server shutting down...")
+	if n := inFlightRequests.count(); n > 0 {
+		logger.Infof("shutting down with %v requests in flight: %v", n, strings.Join(inFlightRequests.describe(), ", "))
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	// The WebSocket connections are hijacked from the servers, so they are closed separately
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if n := openWebSockets.count(); n > 0 {
+			logger.Debugf("closing %v websocket connections", n)
+		}
+		openWebSockets.closeAll(wsShutdownGracePeriod)
+	}()
+	var timedOut int32
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				logger.Errorf("failed to shut down server on %v gracefully: %v", srv.Addr, err)
+				atomic.StoreInt32(&timedOut, 1)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		if n := inFlightRequests.count(); n > 0 {
+			logger.Warnf("force closing %v requests still in flight after %v: %v", n, cfg.ShutdownTimeout, strings.Join(inFlightRequests.describe(), ", "))
+		}
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+	// No more outgoing requests will be made once in-flight requests are done, so release the idle sockets
+	defaultTransport.CloseIdleConnections()
+	logger.Debugf("closed idle connections of the http client")
+
+	if serveErr != nil {
+		return serveErr
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		logger.Infof("server shut down after force closing the remaining requests")
+		return nil
+	}
+	logger.Infof("server shut down cleanly")
+	return nil
+}
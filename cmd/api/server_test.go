@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a local address with a port which is free at the time of the call
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// shutdownEvents records the order in which the steps of the shutdown are observed
+type shutdownEvents struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (e *shutdownEvents) add(event string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *shutdownEvents) get() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+func TestRunShutdownOrder(t *testing.T) {
+	defer func(mode string, delay time.Duration) {
+		drainMode, drainDelay = mode, delay
+		atomic.StoreInt32(&shuttingDown, 0)
+	}(drainMode, drainDelay)
+	drainMode, drainDelay = "fixed", 200*time.Millisecond
+
+	mainAddress, livenessAddress := freeAddress(t), freeAddress(t)
+	var events shutdownEvents
+	slowStarted := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/ready", (&healthService{}).readinessCheck())
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(slowStarted)
+		// Outlasts the drain, so the request is still in flight when the server is shut down
+		time.Sleep(2 * drainDelay)
+		w.Write([]byte("done"))
+		events.add("in-flight request completed")
+	})
+
+	// Every request makes a new connection, so none is reused across the steps of the shutdown
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	get := func(address string, path string) (int, string, error) {
+		resp, err := client.Get("http://" + address + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(ctx, Config{
+			ListenAddresses:       []string{mainAddress},
+			LivenessListenAddress: livenessAddress,
+			Handler:               mux,
+			Drain:                 func() bool { return true },
+			ShutdownTimeout:       5 * time.Second,
+			AfterShutdown: func() {
+				if conn, err := net.Dial("tcp", mainAddress); err == nil {
+					conn.Close()
+					t.Errorf("new connection to %v was accepted after the shutdown", mainAddress)
+				} else {
+					events.add("new connections refused")
+				}
+				events.add("after shutdown")
+				if status, _, err := get(livenessAddress, healthPath); err != nil || status != http.StatusOK {
+					t.Errorf("liveness check during AfterShutdown: status %v, error %v, expected it to still pass", status, err)
+				}
+			},
+			LivenessShutdownDelay: 100 * time.Millisecond,
+		})
+	}()
+
+	// Wait for both servers to be up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _, err := get(mainAddress, "/ready")
+		livenessStatus, _, livenessErr := get(livenessAddress, healthPath)
+		if err == nil && status == http.StatusOK && livenessErr == nil && livenessStatus == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("servers didn't become ready: status %v (%v), liveness status %v (%v)", status, err, livenessStatus, livenessErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		status, body, err := get(mainAddress, "/slow")
+		if err != nil || status != http.StatusOK || body != "done" {
+			t.Errorf("in-flight request: status %v, body %q, error %v, expected it to complete", status, body, err)
+		}
+	}()
+	<-slowStarted
+	cancel()
+
+	// The readiness check fails while draining, when the server still accepts connections
+	for {
+		status, _, err := get(mainAddress, "/ready")
+		if err == nil && status == http.StatusServiceUnavailable {
+			events.add("readiness failed")
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("readiness check didn't fail while draining: status %v, error %v", status, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-slowDone
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't return after the shutdown")
+	}
+	if _, _, err := get(livenessAddress, healthPath); err == nil {
+		t.Errorf("liveness server still answering after Run returned")
+	} else {
+		events.add("liveness server stopped")
+	}
+
+	expected := []string{"readiness failed", "in-flight request completed", "new connections refused", "after shutdown", "liveness server stopped"}
+	if got := events.get(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("shutdown events %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// toggleMaintenanceModeOnSignal turns maintenance mode on or off every time SIGUSR1 is received
+func toggleMaintenanceModeOnSignal() {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	for range sigusr1 {
+		setMaintenanceMode(!isInMaintenanceMode())
+		logger.Warnf("received SIGUSR1, maintenance mode: %v", isInMaintenanceMode())
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// toggleMaintenanceModeOnSignal does nothing, as there is no SIGUSR1 on Windows
+func toggleMaintenanceModeOnSignal() {}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	ocpropagation "go.opencensus.io/trace/propagation"
+)
+
+// newPropagationFormat returns the format in which the trace context is read from incoming requests and written
+// to outgoing ones: "gcp" for the X-Cloud-Trace-Context header, "w3c" for the traceparent header of W3C Trace Context
+func newPropagationFormat(name string) ocpropagation.HTTPFormat {
+	if name == "w3c" {
+		return &tracecontext.HTTPFormat{}
+	}
+	return &propagation.HTTPFormat{}
+}
+
+const (
+	// maxPendingTraces bounds the number of traces for which spans are buffered by the tailSamplingExporter
+	maxPendingTraces = 1000
+	// pendingTraceTTL is how long spans are buffered waiting for the server span of their trace. Spans which end after
+	// it (e.g. of a coalesced call outliving the request which started it) are never matched, so they are evicted.
+	pendingTraceTTL = 5 * time.Minute
+)
+
+// tailSamplingExporter is a trace exporter which decides whether to export a trace once the request has been handled,
+// rather than when it starts: traces of requests which failed or were slow are always exported, the others at a base rate.
+// All spans must be sampled for this to work, so the decision can be made by the exporter instead of the sampler.
+// Spans of a trace (e.g. of outgoing calls) are buffered until the server span of the incoming request ends.
+type tailSamplingExporter struct {
+	exporter         trace.Exporter
+	baseRate         float64
+	latencyThreshold time.Duration
+	errorStatus      int64
+	pendingTTL       time.Duration
+	mutex            sync.Mutex
+	pending          map[trace.TraceID]*pendingTrace
+}
+
+// pendingTrace holds the buffered spans of a trace, and when its first span was buffered
+type pendingTrace struct {
+	spans     []*trace.SpanData
+	firstSeen time.Time
+}
+
+func newTailSamplingExporter(exporter trace.Exporter, baseRate float64, latencyThreshold time.Duration, errorStatus int) *tailSamplingExporter {
+	return &tailSamplingExporter{
+		exporter:         exporter,
+		baseRate:         baseRate,
+		latencyThreshold: latencyThreshold,
+		errorStatus:      int64(errorStatus),
+		pendingTTL:       pendingTraceTTL,
+		pending:          make(map[trace.TraceID]*pendingTrace),
+	}
+}
+
+// ExportSpan buffers the span until the server span of its trace ends, at which point the whole trace is
+// either exported or dropped
+func (e *tailSamplingExporter) ExportSpan(sd *trace.SpanData) {
+	e.mutex.Lock()
+	if sd.SpanKind != trace.SpanKindServer {
+		p, ok := e.pending[sd.TraceID]
+		if !ok && len(e.pending) >= maxPendingTraces {
+			e.evictStaleLocked()
+		}
+		if !ok && len(e.pending) < maxPendingTraces {
+			p = &pendingTrace{firstSeen: time.Now()}
+			e.pending[sd.TraceID] = p
+		}
+		if p != nil {
+			p.spans = append(p.spans, sd)
+		}
+		e.mutex.Unlock()
+		return
+	}
+	var spans []*trace.SpanData
+	if p, ok := e.pending[sd.TraceID]; ok {
+		spans = p.spans
+	}
+	spans = append(spans, sd)
+	delete(e.pending, sd.TraceID)
+	e.mutex.Unlock()
+
+	if !e.shouldExport(sd) {
+		return
+	}
+	for _, span := range spans {
+		e.exporter.ExportSpan(span)
+	}
+}
+
+// evictStaleLocked drops the buffered spans of traces which have been pending for longer than the pendingTTL.
+// The mutex must be held.
+func (e *tailSamplingExporter) evictStaleLocked() {
+	for traceID, p := range e.pending {
+		if time.Since(p.firstSeen) > e.pendingTTL {
+			delete(e.pending, traceID)
+		}
+	}
+}
+
+// shouldExport returns whether the trace of the given server span should be exported
+func (e *tailSamplingExporter) shouldExport(sd *trace.SpanData) bool {
+	if status, ok := sd.Attributes["http.status_code"].(int64); ok && status >= e.errorStatus {
+		return true
+	}
+	if e.latencyThreshold > 0 && sd.EndTime.Sub(sd.StartTime) >= e.latencyThreshold {
+		return true
+	}
+	return rand.Float64() < e.baseRate
+}
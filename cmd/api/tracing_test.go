@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// recordingExporter keeps the spans exported to it
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *recordingExporter) ExportSpan(sd *trace.SpanData) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, sd)
+}
+
+// testSpan returns the data of an ended span of the given trace
+func testSpan(traceID byte, kind int, duration time.Duration, status int64) *trace.SpanData {
+	start := time.Now().Add(-duration)
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: trace.TraceID{traceID}},
+		SpanKind:    kind,
+		StartTime:   start,
+		EndTime:     start.Add(duration),
+	}
+	if status != 0 {
+		sd.Attributes = map[string]interface{}{"http.status_code": status}
+	}
+	return sd
+}
+
+func TestTailSamplingExporterDecision(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseRate float64
+		duration time.Duration
+		status   int64
+		exported bool
+	}{
+		{"fast success", 0, 10 * time.Millisecond, 200, false},
+		{"fast success at full base rate", 1, 10 * time.Millisecond, 200, true},
+		{"server error", 0, 10 * time.Millisecond, 503, true},
+		{"client error", 0, 10 * time.Millisecond, 404, false},
+		{"slow success", 0, 2 * time.Second, 200, true},
+		{"no status", 0, 10 * time.Millisecond, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &recordingExporter{}
+			e := newTailSamplingExporter(recorder, tt.baseRate, time.Second, 500)
+			e.ExportSpan(testSpan(1, trace.SpanKindClient, time.Millisecond, 200))
+			e.ExportSpan(testSpan(1, trace.SpanKindUnspecified, time.Millisecond, 0))
+			// Spans of other traces aren't affected by the decision
+			e.ExportSpan(testSpan(2, trace.SpanKindClient, time.Millisecond, 200))
+			if len(recorder.spans) != 0 {
+				t.Fatalf("%v spans were exported before the server span ended", len(recorder.spans))
+			}
+			e.ExportSpan(testSpan(1, trace.SpanKindServer, tt.duration, tt.status))
+
+			expected := 0
+			if tt.exported {
+				expected = 3
+			}
+			if len(recorder.spans) != expected {
+				t.Errorf("%v spans were exported, expected %v", len(recorder.spans), expected)
+			}
+			if _, ok := e.pending[trace.TraceID{1}]; ok {
+				t.Errorf("the spans of the decided trace are still pending")
+			}
+			if p := e.pending[trace.TraceID{2}]; p == nil || len(p.spans) != 1 {
+				t.Errorf("the span of the other trace is no longer pending")
+			}
+		})
+	}
+}
+
+func TestTailSamplingExporterEvictsStaleTraces(t *testing.T) {
+	recorder := &recordingExporter{}
+	e := newTailSamplingExporter(recorder, 1, time.Second, 500)
+	e.pendingTTL = 50 * time.Millisecond
+
+	// Fill the buffer with spans whose server span never arrives
+	for i := 0; i < maxPendingTraces; i++ {
+		e.ExportSpan(&trace.SpanData{SpanContext: trace.SpanContext{TraceID: trace.TraceID{byte(i), byte(i >> 8), 1}}})
+	}
+	newTrace := func(id byte) {
+		e.ExportSpan(testSpan(id, trace.SpanKindClient, time.Millisecond, 200))
+		e.ExportSpan(testSpan(id, trace.SpanKindServer, time.Millisecond, 200))
+	}
+
+	// While the buffered traces are fresh, the child spans of new traces are dropped
+	newTrace(0xaa)
+	if len(recorder.spans) != 1 {
+		t.Fatalf("%v spans were exported with a full buffer, expected only the server span", len(recorder.spans))
+	}
+
+	// Once they are stale, they make room for new traces
+	time.Sleep(2 * e.pendingTTL)
+	recorder.spans = nil
+	newTrace(0xbb)
+	if len(recorder.spans) != 2 {
+		t.Errorf("%v spans were exported after the stale traces expired, expected 2", len(recorder.spans))
+	}
+	if len(e.pending) != 0 {
+		t.Errorf("%v traces are still pending, expected the stale ones to be evicted", len(e.pending))
+	}
+}